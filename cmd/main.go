@@ -9,7 +9,9 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // база зон внутри бинарника - в alpine-образе ее нет
 
+	"github.com/UnendingLoop/SalesTracker/internal/model"
 	"github.com/UnendingLoop/SalesTracker/internal/repository"
 	"github.com/UnendingLoop/SalesTracker/internal/service"
 	"github.com/UnendingLoop/SalesTracker/internal/transport"
@@ -40,7 +42,27 @@ func main() {
 	// repo
 	repo := repository.NewOperationsRepo(dbConn)
 	// service
-	svc := service.NewOperationService(repo)
+	idempotencyTTL := appConfig.GetDuration("IDEMPOTENCY_TTL")
+	if idempotencyTTL <= 0 {
+		idempotencyTTL = 24 * time.Hour
+	}
+	// зона и начало недели по умолчанию для интервалов аналитики
+	tzName := appConfig.GetString("ANALYTICS_TZ")
+	if tzName == "" {
+		tzName = "UTC"
+	}
+	analyticsLoc, err := time.LoadLocation(tzName)
+	if err != nil {
+		log.Fatalf("Invalid ANALYTICS_TZ %q: %s\nExiting app...", tzName, err)
+	}
+	weekStart := appConfig.GetString("ANALYTICS_WEEK_START")
+	if weekStart == "" {
+		weekStart = model.WeekStartMonday
+	}
+	if _, ok := model.WeekStartMap[weekStart]; !ok {
+		log.Fatalf("Invalid ANALYTICS_WEEK_START %q: must be monday or sunday\nExiting app...", weekStart)
+	}
+	svc := service.NewOperationService(repo, idempotencyTTL, analyticsLoc, weekStart)
 	// handlers
 	handlers := transport.NewOperationHandler(svc)
 	// конфиг сервера
@@ -53,14 +75,25 @@ func main() {
 	engine.Static("/web", "./internal/web")
 
 	operations.POST("", handlers.CreateOperation)
+	operations.POST("/batch", handlers.BatchOperations)
+	operations.POST("/bulk-update", handlers.BulkUpdateOperations)
+	operations.GET("/search", handlers.SearchOperations)
 	operations.GET("/:id", handlers.GetOperationByID)
 	operations.GET("", handlers.GetAllOperations)
 	operations.PATCH("/:id", handlers.UpdateOperationByID)
+	operations.PUT("/:id", handlers.ReplaceOperationByID)
 	operations.DELETE("/:id", handlers.DeleteOperationByID)
 	operations.GET("/csv", handlers.ExportOperationsCSV)
 
 	analytics.GET("", handlers.GetAnalytics)
 	analytics.GET("/csv", handlers.ExportAnalyticsCSV)
+	analytics.GET("/pivot", handlers.GetAnalyticsPivot)
+	analytics.GET("/pivot/csv", handlers.ExportAnalyticsPivotCSV)
+	analytics.GET("/cashflow", handlers.GetCashflow)
+	analytics.GET("/forecast", handlers.GetForecast)
+	analytics.GET("/anomalies", handlers.GetAnomalies)
+	analytics.GET("/top", handlers.GetTop)
+	analytics.GET("/histogram", handlers.GetHistogram)
 
 	srv := &http.Server{
 		Addr:    ":" + appConfig.GetString("APP_PORT"),
@@ -0,0 +1,75 @@
+package filterql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Compile превращает AST в SQL-условие. columns сопоставляет поля фильтра с выражениями запроса
+// (например, "actor" -> "f.fam_member"), arg регистрирует значение как bind-параметр и возвращает его плейсхолдер
+func Compile(node Node, columns map[string]string, arg func(v any) string) (string, error) {
+	switch n := node.(type) {
+	case *Logical:
+		left, err := Compile(n.Left, columns, arg)
+		if err != nil {
+			return "", err
+		}
+		right, err := Compile(n.Right, columns, arg)
+		if err != nil {
+			return "", err
+		}
+		return "(" + left + " " + strings.ToUpper(n.Op) + " " + right + ")", nil
+	case *Not:
+		expr, err := Compile(n.Expr, columns, arg)
+		if err != nil {
+			return "", err
+		}
+		return "(NOT " + expr + ")", nil
+	case *Comparison:
+		return compileComparison(n, columns, arg)
+	default:
+		return "", fmt.Errorf("filterql: unknown node type %T", node)
+	}
+}
+
+func compileComparison(n *Comparison, columns map[string]string, arg func(v any) string) (string, error) {
+	col, ok := columns[n.Field]
+	if !ok {
+		return "", fmt.Errorf("filterql: no column mapping for field %q", n.Field)
+	}
+	nullable := fields[n.Field].nullable
+
+	switch n.Op {
+	case OpEq, OpLt, OpLe, OpGt, OpGe:
+		return col + " " + n.Op + " " + arg(n.Values[0]), nil
+	case OpNe:
+		// "actor != son" должен включать и операции без актора
+		return col + " IS DISTINCT FROM " + arg(n.Values[0]), nil
+	case OpMatch, OpNotMatch:
+		text, _ := n.Values[0].(string)
+		if n.Op == OpMatch {
+			return col + " ILIKE " + arg(ContainsPattern(text)), nil
+		}
+		return "(" + col + " IS NULL OR " + col + " NOT ILIKE " + arg(ContainsPattern(text)) + ")", nil
+	case OpIn, OpNotIn:
+		placeholders := make([]string, 0, len(n.Values))
+		for _, v := range n.Values {
+			placeholders = append(placeholders, arg(v))
+		}
+		list := strings.Join(placeholders, ", ")
+		if n.Op == OpIn {
+			return col + " IN (" + list + ")", nil
+		}
+		if nullable {
+			return "(" + col + " IS NULL OR " + col + " NOT IN (" + list + "))", nil
+		}
+		return col + " NOT IN (" + list + ")", nil
+	default:
+		return "", fmt.Errorf("filterql: unknown operator %q", n.Op)
+	}
+}
+
+// ContainsPattern строит шаблон ILIKE для поиска подстроки, экранируя спецсимволы LIKE, - общий для q и фильтра description
+func ContainsPattern(s string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s) + "%"
+}
@@ -0,0 +1,122 @@
+// Package filterql - маленький язык фильтров для операций и аналитики:
+//
+//	category in (food, health) and amount < -1000 and actor != son and description ~ "pharm"
+//
+// Выражение разбирается в AST (Parse) и компилируется в параметризованное SQL-условие (Compile):
+// значения никогда не попадают в текст запроса, а поля ограничены белым списком.
+package filterql
+
+import (
+	"fmt"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+const (
+	MaxQueryLen = 1000 // защита от слишком длинных выражений
+	MaxDepth    = 32   // защита от слишком глубокой вложенности скобок/not
+)
+
+// Error - ошибка разбора с позицией (номер символа, начиная с 1)
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("invalid filter query at position %d: %s", e.Pos, e.Msg)
+}
+
+// Unwrap позволяет проверять ошибку через errors.Is(err, model.ErrInvalidQuery)
+func (e *Error) Unwrap() error {
+	return model.ErrInvalidQuery
+}
+
+func errorf(pos int, format string, args ...any) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+type fieldKind int
+
+const (
+	kindInt  fieldKind = iota // id, amount, abs_amount
+	kindEnum                  // actor, category, type
+	kindTime                  // operation_at
+	kindText                  // description
+)
+
+type fieldSpec struct {
+	kind     fieldKind
+	nullable bool                // может быть NULL в БД - для != и not in нужна отдельная обработка
+	unsigned bool                // для kindInt: отрицательные значения не принимаются
+	values   map[string]struct{} // допустимые значения для kindEnum
+}
+
+const (
+	// FieldDescription - поле описания: в OrderMap его нет, но по нему нужен поиск подстроки
+	FieldDescription = "description"
+	// FieldAbsAmount - сумма по модулю, как в amount_min/amount_max; amount остается со знаком
+	FieldAbsAmount = "abs_amount"
+)
+
+// fields - белый список полей, повторяет model.OrderMap (+ description, abs_amount)
+var fields = map[string]fieldSpec{
+	model.OrderByOpID:     {kind: kindInt},
+	model.OrderByAmount:   {kind: kindInt},
+	FieldAbsAmount:        {kind: kindInt, unsigned: true},
+	model.OrderByActor:    {kind: kindEnum, nullable: true, values: withOther(model.ActorsMap, model.FamOther)},
+	model.OrderByCategory: {kind: kindEnum, nullable: true, values: withOther(model.CategoriesMap, model.CatOther)},
+	model.OrderByType:     {kind: kindEnum, values: model.OpTypeMap},
+	model.OrderByOpDate:   {kind: kindTime},
+	FieldDescription:      {kind: kindText, nullable: true},
+}
+
+// withOther добавляет "other" - в фильтрах он допустим, хотя создать операцию с ним нельзя
+func withOther(src map[string]struct{}, other string) map[string]struct{} {
+	result := make(map[string]struct{}, len(src)+1)
+	for k := range src {
+		result[k] = struct{}{}
+	}
+	result[other] = struct{}{}
+	return result
+}
+
+// Node - узел AST
+type Node interface {
+	node()
+}
+
+// Logical - and/or
+type Logical struct {
+	Op          string // and/or
+	Left, Right Node
+}
+
+// Not - отрицание
+type Not struct {
+	Expr Node
+}
+
+// Comparison - сравнение поля со значением или списком значений
+type Comparison struct {
+	Field  string
+	Op     string // = != < <= > >= ~ !~ in notin
+	Values []any  // int64, string или time.Time - в зависимости от поля
+}
+
+func (*Logical) node()    {}
+func (*Not) node()        {}
+func (*Comparison) node() {}
+
+const (
+	OpEq       = "="
+	OpNe       = "!="
+	OpLt       = "<"
+	OpLe       = "<="
+	OpGt       = ">"
+	OpGe       = ">="
+	OpMatch    = "~"  // подстрока без учета регистра
+	OpNotMatch = "!~" // не содержит подстроку
+	OpIn       = "in"
+	OpNotIn    = "notin"
+)
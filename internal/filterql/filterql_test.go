@@ -0,0 +1,160 @@
+package filterql
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+var testColumns = map[string]string{
+	model.OrderByOpID:     "o.id",
+	model.OrderByAmount:   "o.amount",
+	FieldAbsAmount:        "ABS(o.amount)",
+	model.OrderByActor:    "f.fam_member",
+	model.OrderByCategory: "c.cat_name",
+	model.OrderByType:     "o.type",
+	model.OrderByOpDate:   "o.operation_at",
+	FieldDescription:      "o.description",
+}
+
+func compile(t *testing.T, node Node) (string, []any) {
+	t.Helper()
+	args := make([]any, 0)
+	sql, err := Compile(node, testColumns, func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	})
+	if err != nil {
+		t.Fatalf("Compile() error: %v", err)
+	}
+	return sql, args
+}
+
+func TestParseAndCompile(t *testing.T) {
+	tests := []struct {
+		query    string
+		wantSQL  string
+		wantArgs int
+	}{
+		{
+			query:    `category in (food, health) and amount < -1000 and actor != son and description ~ "pharm"`,
+			wantSQL:  `(((c.cat_name IN ($1, $2) AND o.amount < $3) AND f.fam_member IS DISTINCT FROM $4) AND o.description ILIKE $5)`,
+			wantArgs: 5,
+		},
+		{
+			query:    `not (type = debit or amount >= 500000)`,
+			wantSQL:  `(NOT (o.type = $1 OR o.amount >= $2))`,
+			wantArgs: 2,
+		},
+		{
+			query:    `type = credit and abs_amount > 1000`,
+			wantSQL:  `(o.type = $1 AND ABS(o.amount) > $2)`,
+			wantArgs: 2,
+		},
+		{
+			query:    `actor NOT IN (son, daughter) AND operation_at >= 2026-01-01`,
+			wantSQL:  `((f.fam_member IS NULL OR f.fam_member NOT IN ($1, $2)) AND o.operation_at >= $3)`,
+			wantArgs: 3,
+		},
+		{
+			query:    `description !~ 'it''s'`,
+			wantSQL:  "",
+			wantArgs: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		node, err := Parse(tt.query)
+		if tt.wantArgs < 0 {
+			if err == nil {
+				t.Errorf("Parse(%q) expected error", tt.query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", tt.query, err)
+		}
+
+		sql, args := compile(t, node)
+		if sql != tt.wantSQL {
+			t.Errorf("Compile(%q)\n got: %s\nwant: %s", tt.query, sql, tt.wantSQL)
+		}
+		if len(args) != tt.wantArgs {
+			t.Errorf("Compile(%q) args = %d, want %d", tt.query, len(args), tt.wantArgs)
+		}
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantPos int
+	}{
+		{query: `amount < abc`, wantPos: 10},
+		{query: `abs_amount > -1000`, wantPos: 14},
+		{query: `colour = red`, wantPos: 1},
+		{query: `actor = son and`, wantPos: 16},
+		{query: `category in (food, pets)`, wantPos: 20},
+		{query: `description ~ "pharm`, wantPos: 15},
+		{query: `amount ~ 100`, wantPos: 8},
+		{query: `(type = debit`, wantPos: 14},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse(tt.query)
+		var qerr *Error
+		if !errors.As(err, &qerr) {
+			t.Fatalf("Parse(%q) error = %v, want *Error", tt.query, err)
+		}
+		if qerr.Pos != tt.wantPos {
+			t.Errorf("Parse(%q) error position = %d, want %d (%v)", tt.query, qerr.Pos, tt.wantPos, qerr)
+		}
+		if !errors.Is(err, model.ErrInvalidQuery) {
+			t.Errorf("Parse(%q) error does not wrap model.ErrInvalidQuery", tt.query)
+		}
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	seeds := []string{
+		`category in (food, health) and amount < -1000 and actor != son and description ~ "pharm"`,
+		`abs_amount between 1`,
+		`not (type = debit or amount >= 500000)`,
+		`actor not in (son, daughter) and operation_at >= 2026-01-01T00:00:00Z`,
+		`description = 'O\'Reilly' or id <> 7`,
+		`((((amount > 1))))`,
+		`amount <`,
+		`"`,
+		``,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		node, err := Parse(query)
+		if err != nil {
+			var qerr *Error
+			if !errors.As(err, &qerr) {
+				t.Fatalf("Parse(%q) returned %T, want *Error", query, err)
+			}
+			if qerr.Pos < 1 || qerr.Pos > utf8.RuneCountInString(query)+1 {
+				t.Fatalf("Parse(%q) error position %d is out of range", query, qerr.Pos)
+			}
+			return
+		}
+
+		// значения никогда не попадают в текст запроса - только плейсхолдеры
+		sql, args := compile(t, node)
+		if strings.ContainsAny(sql, "'\";") {
+			t.Fatalf("Compile(%q) leaked a literal into SQL: %s", query, sql)
+		}
+		if strings.Count(sql, "$") != len(args) {
+			t.Fatalf("Compile(%q) placeholders/args mismatch: %s (%d args)", query, sql, len(args))
+		}
+	})
+}
@@ -0,0 +1,336 @@
+package filterql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF    tokenKind = iota
+	tokWord             // поле, ключевое слово или значение без кавычек
+	tokString           // значение в кавычках
+	tokOp               // оператор сравнения
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// Parse разбирает выражение фильтра; ошибки возвращаются как *Error с позицией
+func Parse(query string) (Node, error) {
+	if !utf8.ValidString(query) {
+		return nil, errorf(1, "query is not valid UTF-8")
+	}
+	if utf8.RuneCountInString(query) > MaxQueryLen {
+		return nil, errorf(MaxQueryLen+1, "query is longer than %d characters", MaxQueryLen)
+	}
+
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, errorf(p.peek().pos, "empty query")
+	}
+
+	node, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, errorf(tok.pos, "unexpected %q", tok.text)
+	}
+
+	return node, nil
+}
+
+func tokenize(query string) ([]token, error) {
+	runes := []rune(query)
+	tokens := make([]token, 0)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		pos := i + 1
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: pos})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: pos})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokComma, text: ",", pos: pos})
+			i++
+		case r == '"' || r == '\'':
+			// строка в кавычках, внутри допустимы \" \' и \\
+			var sb strings.Builder
+			j := i + 1
+			closed := false
+			for j < len(runes) {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					sb.WriteRune(runes[j+1])
+					j += 2
+					continue
+				}
+				if runes[j] == r {
+					closed = true
+					break
+				}
+				sb.WriteRune(runes[j])
+				j++
+			}
+			if !closed {
+				return nil, errorf(pos, "unterminated string")
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: pos})
+			i = j + 1
+		case strings.ContainsRune("=!<>~", r):
+			raw := string(r)
+			if i+1 < len(runes) {
+				switch two := raw + string(runes[i+1]); two {
+				case "!=", "<=", ">=", "!~", "<>":
+					raw = two
+				}
+			}
+			op := raw
+			switch raw {
+			case "!":
+				return nil, errorf(pos, "unknown operator %q", raw)
+			case "<>":
+				op = OpNe
+			}
+			tokens = append(tokens, token{kind: tokOp, text: op, pos: pos})
+			i += utf8.RuneCountInString(raw)
+		default:
+			j := i
+			for j < len(runes) && isWordRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokWord, text: string(runes[i:j]), pos: pos})
+			i = j
+		}
+	}
+
+	tokens = append(tokens, token{kind: tokEOF, text: "end of query", pos: len(runes) + 1})
+	return tokens, nil
+}
+
+func isWordRune(r rune) bool {
+	return !unicode.IsSpace(r) && !strings.ContainsRune(`()",'=!<>~`, r)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// isKeyword - ключевые слова регистронезависимы
+func isKeyword(tok token, kw string) bool {
+	return tok.kind == tokWord && strings.EqualFold(tok.text, kw)
+}
+
+func (p *parser) parseOr(depth int) (Node, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for isKeyword(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "or", Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd(depth int) (Node, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for isKeyword(p.peek(), "and") {
+		p.next()
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &Logical{Op: "and", Left: left, Right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary(depth int) (Node, error) {
+	if depth > MaxDepth {
+		return nil, errorf(p.peek().pos, "expression is nested deeper than %d levels", MaxDepth)
+	}
+
+	tok := p.peek()
+	switch {
+	case isKeyword(tok, "not"):
+		p.next()
+		expr, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: expr}, nil
+	case tok.kind == tokLParen:
+		p.next()
+		expr, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokRParen {
+			return nil, errorf(closing.pos, "expected \")\", got %q", closing.text)
+		}
+		return expr, nil
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *parser) parseComparison() (Node, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokWord {
+		return nil, errorf(fieldTok.pos, "expected field name, got %q", fieldTok.text)
+	}
+	field := strings.ToLower(fieldTok.text)
+	spec, ok := fields[field]
+	if !ok {
+		return nil, errorf(fieldTok.pos, "unknown field %q", fieldTok.text)
+	}
+
+	// оператор: символьный, in или not in
+	opTok := p.next()
+	var op string
+	switch {
+	case opTok.kind == tokOp:
+		op = opTok.text
+	case isKeyword(opTok, "in"):
+		op = OpIn
+	case isKeyword(opTok, "not") && isKeyword(p.peek(), "in"):
+		p.next()
+		op = OpNotIn
+	default:
+		return nil, errorf(opTok.pos, "expected operator after %q, got %q", fieldTok.text, opTok.text)
+	}
+	if !operatorAllowed(spec.kind, op) {
+		return nil, errorf(opTok.pos, "operator %q is not supported for field %q", opTok.text, field)
+	}
+
+	if op != OpIn && op != OpNotIn {
+		value, err := p.parseValue(field, spec)
+		if err != nil {
+			return nil, err
+		}
+		return &Comparison{Field: field, Op: op, Values: []any{value}}, nil
+	}
+
+	// список значений в скобках
+	if lp := p.next(); lp.kind != tokLParen {
+		return nil, errorf(lp.pos, "expected \"(\" after in, got %q", lp.text)
+	}
+	values := make([]any, 0)
+	for {
+		value, err := p.parseValue(field, spec)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		sep := p.next()
+		if sep.kind == tokRParen {
+			break
+		}
+		if sep.kind != tokComma {
+			return nil, errorf(sep.pos, "expected \",\" or \")\", got %q", sep.text)
+		}
+	}
+
+	return &Comparison{Field: field, Op: op, Values: values}, nil
+}
+
+func (p *parser) parseValue(field string, spec fieldSpec) (any, error) {
+	tok := p.next()
+	if tok.kind != tokWord && tok.kind != tokString {
+		return nil, errorf(tok.pos, "expected value for %q, got %q", field, tok.text)
+	}
+
+	switch spec.kind {
+	case kindInt:
+		v, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, errorf(tok.pos, "value %q for %q must be an integer", tok.text, field)
+		}
+		if spec.unsigned && v < 0 {
+			return nil, errorf(tok.pos, "value %q for %q must not be negative: it is compared by absolute value", tok.text, field)
+		}
+		return v, nil
+	case kindEnum:
+		v := strings.ToLower(tok.text)
+		if _, ok := spec.values[v]; !ok {
+			return nil, errorf(tok.pos, "unknown %s %q", field, tok.text)
+		}
+		return v, nil
+	case kindTime:
+		v, err := parseTime(tok.text)
+		if err != nil {
+			return nil, errorf(tok.pos, "value %q for %q must be a date (2006-01-02) or RFC3339 time", tok.text, field)
+		}
+		return v, nil
+	default:
+		return tok.text, nil
+	}
+}
+
+func operatorAllowed(kind fieldKind, op string) bool {
+	switch kind {
+	case kindInt, kindTime:
+		return op != OpMatch && op != OpNotMatch
+	case kindEnum:
+		return op == OpEq || op == OpNe || op == OpIn || op == OpNotIn
+	default:
+		return op == OpEq || op == OpNe || op == OpMatch || op == OpNotMatch
+	}
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, strconv.ErrSyntax
+}
@@ -0,0 +1,116 @@
+// Package forecast - прогноз помесячных сумм по истории без обращения к БД.
+//
+// Модель: уровень ряда - среднее последних месяцев с поправкой на сезонность, сезонный индекс месяца года -
+// среднее значение этого месяца в истории относительно среднего по всей истории. Прогноз = уровень * индекс,
+// ширина коридора - разброс очищенного от сезонности ряда.
+package forecast
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	LevelMonths    = 3      // сколько последних месяцев формируют уровень
+	SeasonalMonths = 24     // сезонность учитывается, если в истории есть хотя бы два полных года
+	Confidence     = 0.8    // доверительный уровень коридора
+	z80            = 1.2816 // квантиль нормального распределения для Confidence
+)
+
+// Prediction - прогноз на один месяц. Lower не опускается ниже 0: суммы доходов и расходов неотрицательны
+type Prediction struct {
+	Month time.Time
+	Value float64
+	Sigma float64 // стандартное отклонение прогноза - для сложения коридоров независимых рядов
+	Lower float64
+	Upper float64
+}
+
+// Monthly прогнозирует horizon месяцев, начиная с месяца, следующего за историей.
+// values[i] - сумма за месяц start+i, пропущенные месяцы должны быть переданы нулями
+func Monthly(start time.Time, values []float64, horizon int) []Prediction {
+	if horizon <= 0 {
+		return nil
+	}
+	start = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, start.Location())
+
+	index := seasonalIndex(start, values)
+	deseasoned := make([]float64, len(values))
+	for i, v := range values {
+		deseasoned[i] = v / index[monthOf(start, i)-1]
+	}
+
+	level := mean(deseasoned[max(0, len(deseasoned)-LevelMonths):])
+	sigma := stddev(deseasoned)
+
+	result := make([]Prediction, 0, horizon)
+	for h := range horizon {
+		i := len(values) + h
+		k := index[monthOf(start, i)-1]
+		p := Prediction{Month: start.AddDate(0, i, 0), Value: level * k, Sigma: sigma * k}
+		p.Lower, p.Upper = Band(p.Value, p.Sigma)
+		p.Lower = math.Max(p.Lower, 0)
+		result = append(result, p)
+	}
+	return result
+}
+
+// Band - коридор Confidence вокруг значения при нормальной ошибке
+func Band(value, sigma float64) (lower, upper float64) {
+	return value - z80*sigma, value + z80*sigma
+}
+
+// seasonalIndex - индекс по месяцам года; без двух лет истории или при нулевом среднем все индексы равны 1
+func seasonalIndex(start time.Time, values []float64) [12]float64 {
+	var index [12]float64
+	for m := range index {
+		index[m] = 1
+	}
+	total := mean(values)
+	if len(values) < SeasonalMonths || total <= 0 {
+		return index
+	}
+
+	var sums [12]float64
+	var counts [12]int
+	for i, v := range values {
+		m := monthOf(start, i) - 1
+		sums[m] += v
+		counts[m]++
+	}
+	for m := range index {
+		// нулевой индекс не дал бы очистить ряд от сезонности - такой месяц считается обычным
+		if counts[m] > 0 && sums[m] > 0 {
+			index[m] = sums[m] / float64(counts[m]) / total
+		}
+	}
+	return index
+}
+
+func monthOf(start time.Time, i int) int {
+	return int(start.AddDate(0, i, 0).Month())
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// stddev - выборочное отклонение; по одной точке 0
+func stddev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m := mean(values)
+	var sum float64
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
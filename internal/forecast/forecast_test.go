@@ -0,0 +1,77 @@
+package forecast
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func month(year int, m time.Month) time.Time {
+	return time.Date(year, m, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestMonthlyFlatHistory(t *testing.T) {
+	values := []float64{1000, 1000, 1000, 1000, 1000, 1000}
+	got := Monthly(month(2026, 1), values, 3)
+
+	if len(got) != 3 {
+		t.Fatalf("len = %d, want 3", len(got))
+	}
+	for i, p := range got {
+		if want := month(2026, time.Month(7+i)); !p.Month.Equal(want) {
+			t.Errorf("[%d] month = %v, want %v", i, p.Month, want)
+		}
+		if p.Value != 1000 || p.Sigma != 0 || p.Lower != 1000 || p.Upper != 1000 {
+			t.Errorf("[%d] = %+v, want exact 1000 without band", i, p)
+		}
+	}
+}
+
+func TestMonthlyLevelUsesRecentMonths(t *testing.T) {
+	// короткая история без сезонности - уровень по последним LevelMonths месяцам
+	values := []float64{100, 100, 100, 400, 500, 600}
+	got := Monthly(month(2026, 1), values, 1)
+
+	if got[0].Value != 500 {
+		t.Errorf("value = %v, want 500", got[0].Value)
+	}
+	if got[0].Lower > got[0].Value || got[0].Upper < got[0].Value || got[0].Lower < 0 {
+		t.Errorf("band = [%v, %v] around %v", got[0].Lower, got[0].Upper, got[0].Value)
+	}
+}
+
+func TestMonthlySeasonality(t *testing.T) {
+	// два года: декабрь втрое дороже остальных месяцев
+	values := make([]float64, 24)
+	for i := range values {
+		values[i] = 100
+		if i%12 == 11 {
+			values[i] = 300
+		}
+	}
+	got := Monthly(month(2024, 1), values, 12)
+
+	dec, nov := got[11], got[10]
+	if dec.Month.Month() != time.December {
+		t.Fatalf("month = %v, want December", dec.Month.Month())
+	}
+	if math.Abs(dec.Value/nov.Value-3) > 1e-9 {
+		t.Errorf("december/november = %v, want 3", dec.Value/nov.Value)
+	}
+}
+
+func TestMonthlyEmpty(t *testing.T) {
+	if got := Monthly(month(2026, 1), nil, 2); len(got) != 2 || got[0].Value != 0 || got[1].Upper != 0 {
+		t.Errorf("empty history = %+v, want zero predictions", got)
+	}
+	if got := Monthly(month(2026, 1), []float64{1}, 0); got != nil {
+		t.Errorf("zero horizon = %+v, want nil", got)
+	}
+}
+
+func TestBand(t *testing.T) {
+	lower, upper := Band(100, 10)
+	if math.Abs(upper-100-(100-lower)) > 1e-9 || upper <= 100 {
+		t.Errorf("band = [%v, %v], want symmetric around 100", lower, upper)
+	}
+}
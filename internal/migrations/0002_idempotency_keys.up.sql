@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    idem_key TEXT PRIMARY KEY,
+    request_hash TEXT NOT NULL,
+    operation_id INT NOT NULL, --без FK: повтор удаленной операции должен вернуть 404, а не создать новую
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Индексы
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys (created_at);
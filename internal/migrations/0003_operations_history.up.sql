@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS operations_history (
+    id BIGSERIAL PRIMARY KEY,
+    operation_id INT NOT NULL, --без FK: история переживает удаление операции
+    action TEXT NOT NULL, --что за изменение, например bulk_update
+    old_data JSONB NOT NULL, --значения измененных полей до
+    new_data JSONB NOT NULL, --значения измененных полей после
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Индексы
+CREATE INDEX IF NOT EXISTS idx_operations_history_operation_id ON operations_history (operation_id);
+
+CREATE INDEX IF NOT EXISTS idx_operations_history_changed_at ON operations_history (changed_at);
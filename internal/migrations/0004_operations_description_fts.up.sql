@@ -0,0 +1,7 @@
+ALTER TABLE operations
+ADD COLUMN IF NOT EXISTS description_tsv tsvector GENERATED ALWAYS AS (
+    to_tsvector('russian', coalesce(description, ''))
+) STORED;
+
+-- Индексы
+CREATE INDEX IF NOT EXISTS idx_operations_description_tsv ON operations USING GIN (description_tsv);
@@ -0,0 +1,9 @@
+ALTER TABLE operations
+ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}', --метки в нижнем регистре, без запятых
+ADD COLUMN IF NOT EXISTS account TEXT, --счет или карта, с которой прошла операция
+ADD CONSTRAINT chk_operations_tags CHECK (cardinality(tags) <= 10); --тот же лимит, что и model.MaxOperationTags
+
+-- Индексы
+CREATE INDEX IF NOT EXISTS idx_operations_tags ON operations USING GIN (tags);
+
+CREATE INDEX IF NOT EXISTS idx_operations_account ON operations (account);
@@ -0,0 +1,3 @@
+ALTER TABLE idempotency_keys
+ADD COLUMN IF NOT EXISTS response_status INT, --статус первого ответа
+ADD COLUMN IF NOT EXISTS response_body TEXT; --тело первого ответа как есть: JSONB переставил бы ключи. Повтор отдает его, даже если операцию потом изменили или удалили
@@ -13,9 +13,52 @@ var (
 	ErrInvalidCategory        = errors.New("invalid category provided")
 	ErrInvalidOpType          = errors.New("invalid operation type provided")
 	ErrInvalidOpTime          = errors.New("invalid operation time provided")
+	ErrInvalidTags            = errors.New("invalid tags provided: at most 10 distinct tags up to 32 characters without commas")
+	ErrInvalidAccount         = errors.New("invalid account provided: must be up to 32 characters without commas")
 	ErrInvalidID              = errors.New("invalid operation ID provided")
 	ErrInvalidAscDesc         = errors.New("invalid ASC/DESC provided")
 	ErrInvalidStartEndTime    = errors.New("invalid start/end time provided: start cannot be later than end")
 	ErrInvalidPage            = errors.New("invalid page value provided: value must be > 0")
 	ErrInvalidLimit           = errors.New("invalid limit value provided: value must be > 0 and < 1000")
+	ErrInvalidIdempotencyKey  = errors.New("invalid Idempotency-Key provided: value must be at most 255 characters")
+	ErrIdempotencyKeyReused   = errors.New("idempotency key was already used with a different payload")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+	ErrIdempotencyKeyExists   = errors.New("idempotency key already exists")
+	ErrInvalidBatchMode       = errors.New("invalid batch mode provided: must be atomic or best_effort")
+	ErrInvalidBatchSize       = errors.New("invalid batch size: must contain from 1 to 1000 commands")
+	ErrInvalidBatchAction     = errors.New("invalid batch action provided: must be create, update, patch or delete")
+	ErrInvalidBatchData       = errors.New("invalid batch command data: must be an operation object")
+	ErrBatchAborted           = errors.New("batch aborted: another command failed and the transaction was rolled back")
+	ErrInvalidAmountRange     = errors.New("invalid amount range provided: bounds must be >= 0 and min cannot exceed max")
+	ErrEmptyBulkFilter        = errors.New("bulk update requires at least one filter")
+	ErrEmptyBulkUpdate        = errors.New("bulk update requires at least one field to change")
+	ErrInvalidQuery           = errors.New("invalid filter query provided")
+	ErrInvalidSearchQuery     = errors.New("invalid search query provided: must contain at least one word")
+	ErrInvalidPagination      = errors.New("invalid pagination provided: must be offset or cursor")
+	ErrInvalidCursor          = errors.New("invalid cursor provided: it is malformed or was issued for a different ordering")
+	ErrCursorWithPage         = errors.New("cursor pagination cannot be combined with page")
+	ErrInvalidPatch           = errors.New("invalid merge patch provided: payload must be a JSON object")
+	ErrInvalidSort            = errors.New("invalid sort provided: expected comma-separated fields like -operation_at,amount,actor:nulls_first")
+	ErrTooManyGroupBy         = errors.New("too many group_by dimensions provided: at most 3 allowed")
+	ErrInvalidPivotDims       = errors.New("invalid pivot dimensions provided: rows and cols must be different group_by values")
+	ErrInvalidMetric          = errors.New("invalid metric provided: must be sum, count, avg, median or p90")
+	ErrInvalidPercentiles     = errors.New("invalid percentiles provided: expected up to 10 distinct numbers between 0 and 100")
+	ErrInvalidStats           = errors.New("invalid stats provided: must be min, max, stddev, variance or mode")
+	ErrInvalidFill            = errors.New("invalid fill provided: must be zero, null or none and requires a single day/week/month/year group_by")
+	ErrInvalidFillWindow      = errors.New("invalid fill window provided: from and to are required, from cannot exceed to, at most 5000 buckets")
+	ErrInvalidTimeZone        = errors.New("invalid tz provided: must be an IANA time zone name like Europe/Moscow")
+	ErrInvalidWeekStart       = errors.New("invalid week_start provided: must be monday or sunday")
+	ErrInvalidInterval        = errors.New("invalid interval provided: must be day, week or month")
+	ErrInvalidCashflowWindow  = errors.New("invalid cashflow window provided: at most 5000 intervals between from and to")
+	ErrInvalidCompare         = errors.New("invalid compare provided: must be previous_period or previous_year and requires from and to, from before to")
+	ErrCompareWithPage        = errors.New("compare cannot be combined with page/limit")
+	ErrInvalidMovingAvg       = errors.New("invalid moving_avg provided: expected up to 5 distinct window sizes between 2 and 366")
+	ErrInvalidEMA             = errors.New("invalid ema provided: must be a number in (0, 1]")
+	ErrInvalidTrendMetric     = errors.New("invalid trend_metric provided: must be sum, income, expense or count")
+	ErrInvalidForecast        = errors.New("invalid forecast params provided: months must be 1..12, history 3..60, from/to are not accepted")
+	ErrInvalidAnomalyParams   = errors.New("invalid anomalies params provided: percentile in (0, 100), z > 0, baseline_days 14..730, duplicate_window like 24h up to 720h, from before to")
+	ErrInvalidTopParams       = errors.New("invalid top params provided: by must be category, actor or description, n must be 1..100")
+	ErrInvalidHistogram       = errors.New("invalid histogram params provided: buckets must be 1..100 or edges 2..101 increasing non-negative amounts, not both")
+	ErrInvalidTrendGroupBy    = errors.New("moving_avg/ema/trend require exactly one day/week/month/year group_by and cannot be combined with page/limit")
+	ErrSortWithOrderBy        = errors.New("sort cannot be combined with order_by/asc/desc")
 )
@@ -1,6 +1,9 @@
 package model
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Operation struct {
 	ID          int64     `json:"id,omitempty"`
@@ -11,8 +14,15 @@ type Operation struct {
 	OperationAt time.Time `json:"operation_at"` // время самой операции
 	CreatedAt   time.Time // время создания записи в БД
 	Description *string   `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`    // метки: в нижнем регистре, без повторов
+	Account     *string   `json:"account,omitempty"` // счет или карта: cash, card...
 }
 
+const (
+	MaxOperationTags = 10 // сколько меток можно повесить на операцию
+	MaxLabelLen      = 32 // длина метки и названия счета в символах
+)
+
 var ActorsMap = map[string]struct{}{FamMother: {}, FamFather: {}, FamDaughter: {}, FamSon: {}}
 
 const (
@@ -48,41 +58,210 @@ const (
 
 // ANALYTICS
 
+type AnalyticsStats struct { // метрики по одному срезу операций, в копейках
+	Sum    float64            `json:"sum"`
+	Avg    float64            `json:"avg"`
+	Count  int                `json:"count"`
+	Median float64            `json:"median"`
+	P90    float64            `json:"p90"`
+	Stats  map[string]float64 `json:"stats,omitempty"` // запрошенные percentiles/stats по суммам этого раздела
+}
+
 type AnalyticsQuantum struct { // возвращается в виде массива если в запросе указана группировка
-	Key    string  `json:"key"`
-	Sum    float64 `json:"sum"`    // сумма в копейках
-	Avg    float64 `json:"avg"`    // среднее в копейках
-	Count  int     `json:"count"`  // кол-во записей, на которых основано вычисление
-	Median float64 `json:"median"` // медиана в копейках
-	P90    float64 `json:"p90"`    // 90й перц в копейках
+	Key     string             `json:"key"`             // значения измерений через GroupKeySeparator - для совместимости с одиночным group_by
+	Keys    map[string]string  `json:"keys"`            // измерение -> значение, например {"month": "2026-01-01", "category": "food"}
+	Sum     float64            `json:"sum"`             // сумма в копейках
+	Avg     float64            `json:"avg"`             // среднее в копейках
+	Count   int                `json:"count"`           // кол-во записей, на которых основано вычисление
+	Median  float64            `json:"median"`          // медиана в копейках
+	P90     float64            `json:"p90"`             // 90й перц в копейках
+	Income  AnalyticsStats     `json:"income"`          // только доходы (debit)
+	Expense AnalyticsStats     `json:"expense"`         // только расходы (credit), суммы по модулю
+	Net     AnalyticsStats     `json:"net"`             // доходы и расходы со знаком - то же, что поля верхнего уровня
+	Stats   map[string]float64 `json:"stats,omitempty"` // запрошенные percentiles/stats: "p95", "min", "stddev"... - то же, что net.stats
+	Trend   *AnalyticsTrend    `json:"trend,omitempty"` // скользящие средние и тренд серии при moving_avg/ema/trend
+	Gap     bool               `json:"-"`               // пустой интервал, добавленный fill=null - метрики отдаются как null
+}
+
+type AnalyticsTrend struct { // считается по серии - группам с одинаковыми значениями невременных измерений
+	MovingAvg map[string]*float64 `json:"moving_avg,omitempty"` // "ma7" -> среднее за 7 интервалов по текущий; null, пока окно не набралось
+	EMA       *float64            `json:"ema,omitempty"`        // экспоненциальное сглаживание
+	Slope     *float64            `json:"slope,omitempty"`      // наклон линейной регрессии серии - изменение за один интервал
+	Fitted    *float64            `json:"fitted,omitempty"`     // значение линии тренда в этом интервале
+}
+
+// MarshalJSON отдает пустой интервал при fill=null с null вместо нулевых метрик - чтобы графики рисовали разрыв
+func (q AnalyticsQuantum) MarshalJSON() ([]byte, error) {
+	type plain AnalyticsQuantum
+	if !q.Gap {
+		return json.Marshal(plain(q))
+	}
+
+	var gapStats map[string]*float64
+	if len(q.Stats) > 0 {
+		gapStats = make(map[string]*float64, len(q.Stats))
+		for key := range q.Stats {
+			gapStats[key] = nil
+		}
+	}
+
+	return json.Marshal(struct {
+		Key     string              `json:"key"`
+		Keys    map[string]string   `json:"keys"`
+		Sum     *float64            `json:"sum"`
+		Avg     *float64            `json:"avg"`
+		Count   int                 `json:"count"`
+		Median  *float64            `json:"median"`
+		P90     *float64            `json:"p90"`
+		Income  *AnalyticsStats     `json:"income"`
+		Expense *AnalyticsStats     `json:"expense"`
+		Net     *AnalyticsStats     `json:"net"`
+		Stats   map[string]*float64 `json:"stats,omitempty"` // те же ключи, что и у заполненных интервалов
+		Trend   *AnalyticsTrend     `json:"trend,omitempty"` // тренд есть и у пустого интервала - для него метрика равна 0
+	}{Key: q.Key, Keys: q.Keys, Stats: gapStats, Trend: q.Trend})
 }
 
 type AnalyticsSummary struct {
-	Key    string             `json:"key,omitempty"` // поле, использованное для группировки
-	Sum    float64            `json:"sum"`
-	Avg    float64            `json:"avg"` // среднее в копейках
-	Count  int                `json:"count"`
-	Median float64            `json:"median"` // медиана в копейках
-	P90    float64            `json:"p90"`    // 90й перц в копейках
-	Groups []AnalyticsQuantum `json:"groups,omitempty"`
+	Key         string               `json:"key,omitempty"` // поле, использованное для группировки
+	Sum         float64              `json:"sum"`
+	Avg         float64              `json:"avg"` // среднее в копейках
+	Count       int                  `json:"count"`
+	Median      float64              `json:"median"` // медиана в копейках
+	P90         float64              `json:"p90"`    // 90й перц в копейках
+	Income      AnalyticsStats       `json:"income"`
+	Expense     AnalyticsStats       `json:"expense"`
+	Net         AnalyticsStats       `json:"net"`
+	Stats       map[string]float64   `json:"stats,omitempty"`
+	StatKeys    []string             `json:"-"`                      // порядок запрошенных stats - для колонок CSV
+	TrendKeys   []string             `json:"-"`                      // порядок колонок тренда в CSV: ma7, ema, trend_slope...
+	TrendMetric string               `json:"trend_metric,omitempty"` // метрика, по которой посчитан trend в группах
+	Groups      []AnalyticsQuantum   `json:"groups,omitempty"`
+	Comparison  *AnalyticsComparison `json:"comparison,omitempty"` // сравнение с предыдущим окном при compare=...
+}
+
+type OperationFilter struct { // набор фильтров операций - общий для списка, аналитики и массовых изменений
+	StartTime   *time.Time `form:"from" json:"from,omitempty"`
+	EndTime     *time.Time `form:"to" json:"to,omitempty"`
+	Actors      []string   `form:"actor" json:"actor,omitempty"`
+	Categories  []string   `form:"category" json:"category,omitempty"`
+	Type        *string    `form:"type" json:"type,omitempty"`
+	Description *string    `form:"description" json:"description,omitempty"` // подстрока описания без учета регистра
+	AmountMin   *int64     `form:"amount_min" json:"amount_min,omitempty"`   // в копейках, по модулю суммы
+	AmountMax   *int64     `form:"amount_max" json:"amount_max,omitempty"`   // в копейках, по модулю суммы
+	Tags        []string   `form:"tag" json:"tag,omitempty"`                 // есть хотя бы одна из меток
+	Accounts    []string   `form:"account" json:"account,omitempty"`
+	Query       *string    `form:"q" json:"q,omitempty"` // выражение на языке фильтров, см. internal/filterql
 }
 
+type BulkUpdateRequest struct {
+	Filter OperationFilter `json:"filter"`
+	Set    BulkUpdateSet   `json:"set"`
+	DryRun bool            `json:"dry_run"` // только посчитать и показать, что будет изменено
+}
+
+type BulkUpdateSet struct { // nil - поле не меняется
+	Actor      *string  `json:"actor,omitempty"`
+	Category   *string  `json:"category,omitempty"`
+	AddTags    []string `json:"add_tags,omitempty"`    // метки, которые нужно добавить к уже имеющимся
+	RemoveTags []string `json:"remove_tags,omitempty"` // метки, которые нужно снять
+}
+
+type BulkUpdateResult struct {
+	DryRun  bool        `json:"dry_run"`
+	Matched int64       `json:"matched"`           // сколько операций подходит под фильтр
+	Updated int64       `json:"updated"`           // сколько изменено (0 при dry_run)
+	Preview []Operation `json:"preview,omitempty"` // первые подходящие операции при dry_run
+}
+
+const BulkPreviewLimit = 20
+
 type RequestParamOperations struct {
-	OrderBy   *string    `form:"order_by"`
-	ASC       bool       `form:"asc"`
-	DESC      bool       `form:"desc"`
-	StartTime *time.Time `form:"from"`
-	EndTime   *time.Time `form:"to"`
-	Page      *int       `form:"page"`
-	Limit     *int       `form:"limit"`
+	OperationFilter
+	OrderBy    *string   `form:"order_by"`
+	SortSpec   *string   `form:"sort"` // несколько ключей: -operation_at,amount,actor:nulls_first
+	ASC        bool      `form:"asc"`
+	DESC       bool      `form:"desc"`
+	Page       *int      `form:"page"`
+	Limit      *int      `form:"limit"`
+	Pagination *string   `form:"pagination"` // offset(по умолчанию)/cursor
+	Cursor     *string   `form:"cursor"`     // токен next_cursor/prev_cursor из предыдущего ответа
+	WithTotal  bool      `form:"with_total"` // посчитать total_count для ответа с курсорами
+	Envelope   bool      `form:"envelope"`   // вернуть страницу в конверте с итогами вместо массива
+	Sort       []SortKey `form:"-"`          // итоговый порядок сортировки, собирается сервисом
+}
+
+type SortKey struct {
+	Field string // поле из OrderMap
+	Desc  bool
+	Nulls string // NullsFirst/NullsLast для actor и category; пусто - как в Postgres: NULL в конце при ASC
+}
+
+type OperationsPage struct { // ответ со страницей операций - для пагинации курсорами
+	Items      []Operation `json:"items"`
+	NextCursor *string     `json:"next_cursor,omitempty"`
+	PrevCursor *string     `json:"prev_cursor,omitempty"`
+	TotalCount *int64      `json:"total_count,omitempty"`
+}
+
+type OperationsEnvelope struct { // страница page/limit вместе с итогами по всему фильтру
+	Items       []Operation `json:"items"`
+	Page        int         `json:"page"`
+	Limit       int         `json:"limit"`
+	TotalCount  int64       `json:"total_count"`
+	TotalAmount int64       `json:"total_amount"` // сумма со знаком по всем подходящим операциям, не только по странице
+	HasMore     bool        `json:"has_more"`
+}
+
+const (
+	PaginationOffset = "offset"
+	PaginationCursor = "cursor"
+	DefaultPageLimit = 20
+)
+
+type RequestParamSearch struct {
+	RequestParamOperations
+	Text  string   `form:"q"` // поисковая строка; q здесь занят ею, поэтому язык фильтров в поиске недоступен
+	Terms []string `form:"-"` // слова поисковой строки после нормализации
+}
+
+type SearchHit struct {
+	Operation
+	Rank    float64 `json:"rank"`    // релевантность ts_rank
+	Snippet string  `json:"snippet"` // фрагмент описания с подсвеченными совпадениями (<b>...</b>)
 }
 
+const MaxSearchTerms = 10
+
+type TimeBuckets struct { // как нарезать время на интервалы day/week/month/year
+	TZ        *string        `form:"tz"`         // IANA-зона, например Europe/Moscow; без параметра - ANALYTICS_TZ из конфига
+	WeekStart *string        `form:"week_start"` // monday/sunday; без параметра - ANALYTICS_WEEK_START из конфига
+	Location  *time.Location `form:"-"`          // зона после проверки
+}
+
+var WeekStartMap = map[string]struct{}{WeekStartMonday: {}, WeekStartSunday: {}}
+
+const (
+	WeekStartMonday = "monday"
+	WeekStartSunday = "sunday"
+)
+
 type RequestParamAnalytics struct {
-	GroupBy   *string    `form:"group_by"`
-	StartTime *time.Time `form:"from"`
-	EndTime   *time.Time `form:"to"`
-	Page      *int       `form:"page"`
-	Limit     *int       `form:"limit"`
+	OperationFilter // summary и группы всегда считаются по одной и той же отфильтрованной выборке
+	TimeBuckets
+	GroupBy     *string  `form:"group_by"` // одно или несколько измерений через запятую: month,category
+	Page        *int     `form:"page"`
+	Limit       *int     `form:"limit"`
+	Percentiles *string  `form:"percentiles"`  // перцентили через запятую: 25,50,75,95,99
+	Stats       *string  `form:"stats"`        // доп. статистика через запятую: min,max,stddev,variance,mode
+	Fill        *string  `form:"fill"`         // zero/null/none(по умолчанию) - заполнение пустых интервалов времени
+	Compare     *string  `form:"compare"`      // previous_period/previous_year - сравнить с предыдущим окном
+	MovingAvg   *string  `form:"moving_avg"`   // окна скользящего среднего в интервалах через запятую: 7,30
+	EMA         *float64 `form:"ema"`          // коэффициент экспоненциального сглаживания в (0, 1]
+	Trend       bool     `form:"trend"`        // посчитать линейный тренд каждой серии
+	TrendMetric *string  `form:"trend_metric"` // sum(по умолчанию)/income/expense/count - по какой метрике считать
+	Windows     []int    `form:"-"`            // окна moving_avg после разбора
+	Dimensions  []string `form:"-"`            // измерения группировки после разбора group_by
+	ExtraStats  []string `form:"-"`            // ключи percentiles и stats после разбора: p25, p99.9, min...
 }
 
 var GroupingMap = map[string]struct{}{GroupByDay: {}, GroupByWeek: {}, GroupByMonth: {}, GroupByYear: {}, GroupByActor: {}, GroupByCategory: {}, GroupByOpType: {}}
@@ -97,6 +276,40 @@ const (
 	GroupByOpType   = "type"
 )
 
+var ExtraStatsMap = map[string]struct{}{StatMin: {}, StatMax: {}, StatStddev: {}, StatVariance: {}, StatMode: {}}
+
+const (
+	StatMin        = "min"
+	StatMax        = "max"
+	StatStddev     = "stddev"
+	StatVariance   = "variance"
+	StatMode       = "mode"
+	MaxPercentiles = 10
+)
+
+var TrendMetricMap = map[string]struct{}{MetricSum: {}, TrendMetricIncome: {}, TrendMetricExpense: {}, MetricCount: {}}
+
+const (
+	TrendMetricIncome  = "income"
+	TrendMetricExpense = "expense"
+	MaxMovingAvgs      = 5
+	MaxMovingAvgWindow = 366
+)
+
+var FillMap = map[string]struct{}{FillZero: {}, FillNull: {}, FillNone: {}}
+
+const (
+	FillZero       = "zero"
+	FillNull       = "null"
+	FillNone       = "none"
+	MaxFillBuckets = 5000
+)
+
+const (
+	MaxGroupByDims    = 3
+	GroupKeySeparator = "|"
+)
+
 var OrderMap = map[string]struct{}{OrderByOpID: {}, OrderByAmount: {}, OrderByActor: {}, OrderByCategory: {}, OrderByType: {}, OrderByOpDate: {}}
 
 const (
@@ -107,3 +320,398 @@ const (
 	OrderByType     = "type"
 	OrderByOpDate   = "operation_at"
 )
+
+const (
+	NullsFirst = "nulls_first"
+	NullsLast  = "nulls_last"
+)
+
+type AnalyticsComparison struct {
+	Mode   string                `json:"mode"`
+	From   time.Time             `json:"from"` // окно, с которым сравниваем
+	To     time.Time             `json:"to"`
+	Totals AnalyticsDeltas       `json:"totals"`
+	Groups []AnalyticsGroupDelta `json:"groups,omitempty"`
+}
+
+type AnalyticsDelta struct {
+	Current  float64  `json:"current"`
+	Previous float64  `json:"previous"`
+	Delta    float64  `json:"delta"`     // current - previous
+	DeltaPct *float64 `json:"delta_pct"` // изменение в % от |previous|; null, если previous = 0
+}
+
+type AnalyticsDeltas struct { // суммы в копейках, расходы по модулю
+	Sum     AnalyticsDelta `json:"sum"`
+	Income  AnalyticsDelta `json:"income"`
+	Expense AnalyticsDelta `json:"expense"`
+	Count   AnalyticsDelta `json:"count"`
+}
+
+type AnalyticsGroupDelta struct {
+	Key    string            `json:"key"`
+	Keys   map[string]string `json:"keys"`
+	Status string            `json:"status"` // matched/new/disappeared
+	AnalyticsDeltas
+}
+
+var CompareMap = map[string]struct{}{ComparePreviousPeriod: {}, ComparePreviousYear: {}}
+
+const (
+	ComparePreviousPeriod = "previous_period"
+	ComparePreviousYear   = "previous_year"
+	DeltaMatched          = "matched"
+	DeltaNew              = "new"         // ключ есть только в текущем окне
+	DeltaDisappeared      = "disappeared" // ключ есть только в предыдущем окне
+)
+
+// PIVOT
+
+type RequestParamPivot struct {
+	OperationFilter
+	TimeBuckets
+	Rows   *string `form:"rows"`   // измерение строк - значение из GroupingMap
+	Cols   *string `form:"cols"`   // измерение колонок - значение из GroupingMap, отличное от rows
+	Metric *string `form:"metric"` // sum(по умолчанию)/count/avg/median/p90
+}
+
+type PivotCell struct { // одна строка результата GROUPING SETS
+	Row      string
+	Col      string
+	RowTotal bool // итог по строке - колонки свернуты
+	ColTotal bool // итог по колонке - строки свернуты
+	Value    *float64
+}
+
+type PivotTable struct {
+	Rows       string       `json:"rows"`
+	Cols       string       `json:"cols"`
+	Metric     string       `json:"metric"`
+	RowKeys    []string     `json:"row_keys"`
+	ColKeys    []string     `json:"col_keys"`
+	Cells      [][]*float64 `json:"cells"` // [строка][колонка], null - в пересечении нет операций
+	RowTotals  []float64    `json:"row_totals"`
+	ColTotals  []float64    `json:"col_totals"`
+	GrandTotal float64      `json:"grand_total"`
+}
+
+var MetricMap = map[string]struct{}{MetricSum: {}, MetricCount: {}, MetricAvg: {}, MetricMedian: {}, MetricP90: {}}
+
+const (
+	MetricSum    = "sum"
+	MetricCount  = "count"
+	MetricAvg    = "avg"
+	MetricMedian = "median"
+	MetricP90    = "p90"
+)
+
+// CASHFLOW
+
+type RequestParamCashflow struct {
+	OperationFilter
+	TimeBuckets
+	Interval       *string `form:"interval"`        // day/week/month(по умолчанию)
+	OpeningBalance *int64  `form:"opening_balance"` // остаток на начало в копейках, по умолчанию 0
+}
+
+type CashflowBucket struct {
+	Bucket  string `json:"bucket"`  // начало интервала, ISO-дата
+	Inflow  int64  `json:"inflow"`  // доходы в копейках
+	Outflow int64  `json:"outflow"` // расходы в копейках, по модулю
+	Net     int64  `json:"net"`     // inflow - outflow
+	Balance int64  `json:"balance"` // остаток на конец интервала: opening_balance + net всех интервалов по этот включительно
+}
+
+type Cashflow struct {
+	Interval       string           `json:"interval"`
+	OpeningBalance int64            `json:"opening_balance"`
+	ClosingBalance int64            `json:"closing_balance"`
+	Buckets        []CashflowBucket `json:"buckets"`
+}
+
+var CashflowIntervalMap = map[string]struct{}{GroupByDay: {}, GroupByWeek: {}, GroupByMonth: {}}
+
+// FORECAST
+
+type RequestParamForecast struct {
+	OperationFilter      // from/to не принимаются - окно истории задает history
+	TimeBuckets          // границы месяцев - в зоне tz
+	Months          *int `form:"months"`  // сколько месяцев прогнозировать, начиная с текущего; по умолчанию 3
+	History         *int `form:"history"` // сколько полных месяцев истории брать; по умолчанию 24
+}
+
+type MonthlyAggregate struct { // суммы по категории за месяц - вход прогноза
+	Month    string  // начало месяца, ISO-дата
+	Category string  // пустая строка - без категории
+	Income   float64 // в копейках
+	Expense  float64 // в копейках, по модулю
+}
+
+type ForecastValue struct {
+	Forecast float64 `json:"forecast"` // в копейках
+	Lower    float64 `json:"lower"`    // нижняя граница коридора
+	Upper    float64 `json:"upper"`    // верхняя граница коридора
+}
+
+type ForecastActual struct { // фактические суммы текущего месяца на момент запроса
+	Income  float64 `json:"income"`
+	Expense float64 `json:"expense"`
+	Net     float64 `json:"net"`
+}
+
+type ForecastMonth struct {
+	Month   string          `json:"month"` // начало месяца, ISO-дата
+	Income  ForecastValue   `json:"income"`
+	Expense ForecastValue   `json:"expense"` // по модулю
+	Net     ForecastValue   `json:"net"`
+	Actual  *ForecastActual `json:"actual,omitempty"` // только для текущего месяца
+}
+
+type ForecastCategory struct {
+	Category string          `json:"category"`
+	Months   []ForecastMonth `json:"months"`
+}
+
+type Forecast struct {
+	Months      int                `json:"months"`
+	History     int                `json:"history"`
+	HistoryFrom string             `json:"history_from"` // первый месяц истории
+	Confidence  float64            `json:"confidence"`   // доверительный уровень коридоров
+	Totals      []ForecastMonth    `json:"totals"`
+	Categories  []ForecastCategory `json:"categories"`
+}
+
+const (
+	DefaultForecastMonths  = 3
+	MaxForecastMonths      = 12
+	DefaultForecastHistory = 24
+	MinForecastHistory     = 3
+	MaxForecastHistory     = 60
+)
+
+// TOP
+
+type RequestParamTop struct {
+	OperationFilter         // type по умолчанию credit - топ расходов; type=debit - топ доходов
+	TimeBuckets             // зона для from/to без смещения
+	By              *string `form:"by"` // category(по умолчанию)/actor/description
+	N               *int    `form:"n"`  // сколько групп вывести, по умолчанию 10
+}
+
+type TopGroup struct { // одна строка результата: группа и итоги по всей выборке
+	Key         string
+	Amount      float64
+	Count       int
+	TotalAmount float64
+	TotalCount  int
+	Groups      int // всего групп в выборке
+	Pareto      int // сколько первых групп набирают ParetoShare суммы
+}
+
+type TopItem struct {
+	Rank               int     `json:"rank"`
+	Key                string  `json:"key"`    // пустая строка - без категории/актора/описания
+	Amount             float64 `json:"amount"` // в копейках, по модулю
+	Count              int     `json:"count"`
+	SharePct           float64 `json:"share_pct"`            // доля в общей сумме, %
+	CumulativeSharePct float64 `json:"cumulative_share_pct"` // доля этой и всех групп выше, %
+}
+
+type TopOthers struct { // все группы за пределами первых n
+	Groups   int     `json:"groups"`
+	Amount   float64 `json:"amount"`
+	Count    int     `json:"count"`
+	SharePct float64 `json:"share_pct"`
+}
+
+type TopBreakdown struct {
+	By           string     `json:"by"`
+	Type         string     `json:"type"`
+	N            int        `json:"n"`
+	TotalAmount  float64    `json:"total_amount"`
+	TotalCount   int        `json:"total_count"`
+	Groups       int        `json:"groups"`
+	ParetoGroups int        `json:"pareto_groups"` // сколько крупнейших групп дают 80% суммы
+	Items        []TopItem  `json:"items"`
+	Others       *TopOthers `json:"others,omitempty"` // нет, если все группы попали в items
+}
+
+var TopByMap = map[string]struct{}{GroupByCategory: {}, GroupByActor: {}, TopByDescription: {}}
+
+const (
+	TopByDescription = "description"
+	DefaultTopN      = 10
+	MaxTopN          = 100
+	ParetoShare      = 0.8
+)
+
+// HISTOGRAM
+
+type RequestParamHistogram struct {
+	OperationFilter         // type по умолчанию credit, суммы по модулю
+	TimeBuckets             // зона для from/to без смещения
+	Buckets         *int    `form:"buckets"`     // число интервалов равной ширины от минимальной до максимальной суммы, по умолчанию 20
+	Edges           *string `form:"edges"`       // свои границы в копейках через запятую по возрастанию: 0,10000,50000
+	ByCategory      bool    `form:"by_category"` // дополнительно гистограмма по каждой категории
+	EdgeValues      []int64 `form:"-"`           // edges после разбора
+}
+
+type HistogramCell struct { // строка результата width_bucket: категория (пусто без by_category), номер интервала и итоги
+	Category string
+	Bucket   int
+	Count    int
+	Amount   float64
+	Min      float64 // минимальная и максимальная сумма всей выборки - границы интервалов равной ширины
+	Max      float64
+}
+
+type HistogramBucket struct {
+	Lower  *float64 `json:"lower"` // включительно; null - ниже первой границы edges
+	Upper  *float64 `json:"upper"` // не включительно, кроме последнего интервала buckets; null - от последней границы edges и выше
+	Count  int      `json:"count"`
+	Amount float64  `json:"amount"` // сумма операций интервала в копейках, по модулю
+}
+
+type HistogramSeries struct {
+	Category string            `json:"category"`
+	Count    int               `json:"count"`
+	Buckets  []HistogramBucket `json:"buckets"`
+}
+
+type Histogram struct {
+	Type       string            `json:"type"`
+	Count      int               `json:"count"`
+	Buckets    []HistogramBucket `json:"buckets"`
+	Categories []HistogramSeries `json:"categories,omitempty"` // при by_category
+}
+
+const (
+	DefaultHistogramBuckets = 20
+	MaxHistogramBuckets     = 100
+)
+
+// ANOMALIES
+
+type RequestParamAnomalies struct {
+	OperationFilter               // from/to - окно проверки, по умолчанию последние 30 дней
+	TimeBuckets                   // зона для from/to без смещения
+	Percentile      *float64      `form:"percentile"`       // порог по перцентилю суммы в категории, по умолчанию 99
+	ZScore          *float64      `form:"z"`                // порог z-оценки, по умолчанию 3
+	BaselineDays    *int          `form:"baseline_days"`    // сколько дней перед окном берется для базовой статистики, по умолчанию 180
+	DuplicateWindow *string       `form:"duplicate_window"` // в течение какого времени одинаковая операция считается повтором, по умолчанию 24h
+	BaselineFrom    time.Time     `form:"-"`                // начало базовой статистики для выбросов - baseline_days до from
+	SpikeFrom       time.Time     `form:"-"`                // начало проверяемой недели - 7 дней до to
+	SpikeWeeks      int           `form:"-"`                // сколько недель перед SpikeFrom дают базу для всплесков
+	DuplicateGap    time.Duration `form:"-"`                // duplicate_window после разбора
+}
+
+type AnomalyBaseline struct { // статистика сумм категории и типа по модулю за базовый период
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	Count      int       `json:"count"`
+	Avg        float64   `json:"avg"`
+	Stddev     float64   `json:"stddev"`
+	Percentile float64   `json:"percentile"` // значение порогового перцентиля
+}
+
+type Anomaly struct {
+	Operation
+	Reason      string           `json:"reason"`                 // amount_outlier/duplicate
+	ZScore      *float64         `json:"z_score,omitempty"`      // для amount_outlier; null, если в базе все суммы одинаковые
+	Baseline    *AnomalyBaseline `json:"baseline,omitempty"`     // для amount_outlier
+	DuplicateOf *int64           `json:"duplicate_of,omitempty"` // для duplicate - ближайшая более ранняя такая же операция
+}
+
+type WeeklyBaseline struct { // недельные расходы категории за базовый период, недели без расходов - нули
+	Weeks  int     `json:"weeks"`
+	Avg    float64 `json:"avg"`
+	Stddev float64 `json:"stddev"`
+}
+
+type CategorySpike struct {
+	Category     string         `json:"category"`
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`
+	Amount       float64        `json:"amount"` // расходы за неделю в копейках, по модулю
+	Count        int            `json:"count"`
+	ZScore       float64        `json:"z_score"`
+	Baseline     WeeklyBaseline `json:"baseline"`
+	OperationIDs []int64        `json:"operation_ids"` // операции недели, из которых сложился всплеск
+}
+
+type Anomalies struct {
+	From       time.Time       `json:"from"`
+	To         time.Time       `json:"to"`
+	Operations []Anomaly       `json:"operations"`
+	Spikes     []CategorySpike `json:"spikes"`
+}
+
+const (
+	AnomalyAmountOutlier     = "amount_outlier"
+	AnomalyDuplicate         = "duplicate"
+	DefaultAnomalyPercentile = 99
+	DefaultAnomalyZScore     = 3
+	DefaultAnomalyDays       = 30 // окно проверки по умолчанию
+	DefaultBaselineDays      = 180
+	MinBaselineDays          = 14 // хотя бы две недели - иначе у всплесков нет разброса
+	MaxBaselineDays          = 730
+	DefaultDuplicateWindow   = 24 * time.Hour
+	MaxDuplicateWindow       = 30 * 24 * time.Hour
+	MinAnomalyBaseline       = 10  // меньше операций в базе - выбросы категории не ищутся
+	MaxAnomalies             = 500 // ограничение каждого списка в ответе
+)
+
+// BATCH
+
+type BatchRequest struct {
+	Mode     string         `json:"mode"` // atomic(по умолчанию)/best_effort
+	Commands []BatchCommand `json:"commands"`
+}
+
+type BatchCommand struct {
+	Action string          `json:"action"`         // create/update/patch/delete
+	ID     int64           `json:"id,omitempty"`   // для update/patch/delete
+	Data   json.RawMessage `json:"data,omitempty"` // операция для create/update, merge patch для patch
+}
+
+type BatchItemResult struct {
+	Index     int        `json:"index"`
+	Action    string     `json:"action"`
+	Status    int        `json:"status"` // HTTP-код, который вернула бы одиночная ручка
+	Operation *Operation `json:"operation,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+	Mode    string            `json:"mode"`
+	Results []BatchItemResult `json:"results"`
+}
+
+var BatchModeMap = map[string]struct{}{BatchAtomic: {}, BatchBestEffort: {}}
+
+const (
+	BatchAtomic     = "atomic"      // все или ничего
+	BatchBestEffort = "best_effort" // каждая команда в своем savepoint, ошибки не откатывают остальные
+
+	BatchCreate = "create"
+	BatchUpdate = "update" // полная замена, как PUT
+	BatchPatch  = "patch"  // JSON Merge Patch, как PATCH
+	BatchDelete = "delete"
+
+	MaxBatchSize = 1000
+)
+
+// IDEMPOTENCY
+
+type IdempotencyRecord struct { // результат первого запроса на создание с данным Idempotency-Key
+	Key         string
+	RequestHash string // отпечаток тела запроса - для отличия повтора от другого запроса с тем же ключом
+	OperationID int64
+	Response    *IdempotentResponse // nil у ключей, сохраненных до появления колонок ответа
+	CreatedAt   time.Time
+}
+
+type IdempotentResponse struct { // ответ на первый запрос - повтор отдает его без изменений
+	Status int
+	Body   []byte
+}
@@ -0,0 +1,196 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// sortColumn описывает поле сортировки: выражение в запросе и приведение типа для значения из курсора
+type sortColumn struct {
+	expr     string
+	cast     string
+	nullable bool // actor/category становятся NULL после ON DELETE SET NULL
+	value    func(op *model.Operation) string
+}
+
+var sortColumns = map[string]sortColumn{
+	model.OrderByOpID: {expr: "o.id", cast: "bigint",
+		value: func(op *model.Operation) string { return strconv.FormatInt(op.ID, 10) }},
+	model.OrderByAmount: {expr: "o.amount", cast: "bigint",
+		value: func(op *model.Operation) string { return strconv.FormatInt(op.Amount, 10) }},
+	model.OrderByActor: {expr: "f.fam_member", cast: "text", nullable: true,
+		value: func(op *model.Operation) string { return op.Actor }},
+	model.OrderByCategory: {expr: "c.cat_name", cast: "text", nullable: true,
+		value: func(op *model.Operation) string { return op.Category }},
+	model.OrderByType: {expr: "o.type", cast: "operation_type",
+		value: func(op *model.Operation) string { return op.Type }},
+	model.OrderByOpDate: {expr: "o.operation_at", cast: "timestamptz",
+		value: func(op *model.Operation) string { return op.OperationAt.Format(time.RFC3339Nano) }},
+}
+
+// sortTerm - один ключ ORDER BY, по которому строится и условие keyset-пагинации
+type sortTerm struct {
+	expr  string
+	cast  string
+	desc  bool
+	value func(op *model.Operation) string
+}
+
+// defineSortTerms разворачивает ключи сортировки в термы ORDER BY и добавляет id для однозначности порядка.
+// NULL не сравнивается через < и >, поэтому nullable-поле превращается в пару термов: признак NULL и значение без NULL
+func defineSortTerms(keys []model.SortKey) ([]sortTerm, error) {
+	terms := make([]sortTerm, 0, len(keys)*2+1)
+	hasID := false
+
+	for _, key := range keys {
+		col, ok := sortColumns[key.Field]
+		if !ok {
+			return nil, model.ErrInvalidOrderBy
+		}
+		if key.Field == model.OrderByOpID {
+			hasID = true
+		}
+
+		if col.nullable {
+			// по умолчанию как в Postgres: NULL в конце при ASC и в начале при DESC
+			nullsFirst := key.Desc
+			switch key.Nulls {
+			case model.NullsFirst:
+				nullsFirst = true
+			case model.NullsLast:
+				nullsFirst = false
+			}
+			terms = append(terms, sortTerm{
+				expr: "(" + col.expr + " IS NULL)",
+				cast: "boolean",
+				desc: nullsFirst,
+				value: func(op *model.Operation) string {
+					return strconv.FormatBool(col.value(op) == "")
+				},
+			})
+			terms = append(terms, sortTerm{expr: "COALESCE(" + col.expr + ", '')", cast: col.cast, desc: key.Desc, value: col.value})
+			continue
+		}
+		terms = append(terms, sortTerm{expr: col.expr, cast: col.cast, desc: key.Desc, value: col.value})
+	}
+
+	if !hasID {
+		// направление тай-брейкера - как у последнего ключа, чтобы не ломать индексный порядок
+		desc := len(keys) > 0 && keys[len(keys)-1].Desc
+		id := sortColumns[model.OrderByOpID]
+		terms = append(terms, sortTerm{expr: id.expr, cast: id.cast, desc: desc, value: id.value})
+	}
+
+	return terms, nil
+}
+
+// orderByExpr строит ORDER BY - общий для списка, поиска и пагинации курсорами; reverse переворачивает направления - для выборки страницы "назад"
+func orderByExpr(terms []sortTerm, reverse bool) string {
+	parts := make([]string, 0, len(terms))
+	for _, t := range terms {
+		if t.desc != reverse {
+			parts = append(parts, t.expr+" DESC")
+		} else {
+			parts = append(parts, t.expr+" ASC")
+		}
+	}
+	return "ORDER BY " + strings.Join(parts, ", ")
+}
+
+// keysetCond строит условие "строго после курсора" в порядке сортировки:
+// (t1 > v1) OR (t1 = v1 AND t2 > v2) OR ... ; для reverse - "строго перед курсором"
+func (fb *filterBuilder) keysetCond(terms []sortTerm, values []string, reverse bool) {
+	ors := make([]string, 0, len(terms))
+	for i, t := range terms {
+		ands := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			ands = append(ands, terms[j].expr+" = "+fb.arg(values[j])+"::"+terms[j].cast)
+		}
+		op := ">"
+		if t.desc != reverse {
+			op = "<"
+		}
+		ands = append(ands, t.expr+" "+op+" "+fb.arg(values[i])+"::"+t.cast)
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+	fb.add("(" + strings.Join(ors, " OR ") + ")")
+}
+
+// cursorToken - содержимое непрозрачного курсора
+type cursorToken struct {
+	Sort   string   `json:"s"` // сигнатура сортировки: курсор годится только для того же порядка
+	Values []string `json:"v"` // значения термов сортировки у граничной строки
+	Prev   bool     `json:"p"` // курсор ведет на предыдущую страницу
+}
+
+func sortSignature(keys []model.SortKey) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		part := k.Field
+		if k.Desc {
+			part = "-" + part
+		}
+		if k.Nulls != "" {
+			part += ":" + k.Nulls
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ",")
+}
+
+func encodeCursor(keys []model.SortKey, terms []sortTerm, op *model.Operation, prev bool) string {
+	values := make([]string, 0, len(terms))
+	for _, t := range terms {
+		values = append(values, t.value(op))
+	}
+
+	raw, _ := json.Marshal(cursorToken{Sort: sortSignature(keys), Values: values, Prev: prev})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string, keys []model.SortKey, terms []sortTerm) (*cursorToken, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, model.ErrInvalidCursor
+	}
+
+	var cursor cursorToken
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, model.ErrInvalidCursor
+	}
+	if cursor.Sort != sortSignature(keys) || len(cursor.Values) != len(terms) {
+		return nil, model.ErrInvalidCursor
+	}
+	// курсор приходит от клиента - значения проверяем до того, как они попадут в приведение типов в SQL
+	for i, t := range terms {
+		if !validCursorValue(t.cast, cursor.Values[i]) {
+			return nil, model.ErrInvalidCursor
+		}
+	}
+
+	return &cursor, nil
+}
+
+func validCursorValue(cast, v string) bool {
+	switch cast {
+	case "bigint":
+		_, err := strconv.ParseInt(v, 10, 64)
+		return err == nil
+	case "boolean":
+		_, err := strconv.ParseBool(v)
+		return err == nil
+	case "timestamptz":
+		_, err := time.Parse(time.RFC3339Nano, v)
+		return err == nil
+	case "operation_type":
+		_, ok := model.OpTypeMap[v]
+		return ok
+	default:
+		return true
+	}
+}
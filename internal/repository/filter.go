@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/UnendingLoop/SalesTracker/internal/filterql"
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// filterBuilder собирает WHERE из условий с bind-параметрами - значения фильтров никогда не попадают в текст запроса
+type filterBuilder struct {
+	conds []string
+	args  []any
+}
+
+// newFilterBuilder принимает уже занятые запросом параметры - плейсхолдеры фильтра продолжат их нумерацию
+func newFilterBuilder(args ...any) *filterBuilder {
+	return &filterBuilder{args: args}
+}
+
+// arg добавляет значение в список параметров и возвращает его плейсхолдер
+func (fb *filterBuilder) arg(v any) string {
+	fb.args = append(fb.args, v)
+	return "$" + strconv.Itoa(len(fb.args))
+}
+
+// in возвращает список плейсхолдеров для IN (...)
+func (fb *filterBuilder) in(values []string) string {
+	placeholders := make([]string, 0, len(values))
+	for _, v := range values {
+		placeholders = append(placeholders, fb.arg(v))
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+func (fb *filterBuilder) add(cond string) {
+	fb.conds = append(fb.conds, cond)
+}
+
+func (fb *filterBuilder) where() string {
+	if len(fb.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(fb.conds, " AND ")
+}
+
+// condition возвращает условия без WHERE - для ON в JOIN; без условий - TRUE
+func (fb *filterBuilder) condition() string {
+	if len(fb.conds) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(fb.conds, " AND ")
+}
+
+// filterColumns сопоставляет поля языка фильтров с выражениями запроса
+var filterColumns = map[string]string{
+	model.OrderByOpID:         "o.id",
+	model.OrderByAmount:       "o.amount", // со знаком: расходы отрицательные
+	filterql.FieldAbsAmount:   "ABS(o.amount)",
+	model.OrderByActor:        "f.fam_member",
+	model.OrderByCategory:     "c.cat_name",
+	model.OrderByType:         "o.type",
+	model.OrderByOpDate:       "o.operation_at",
+	filterql.FieldDescription: "o.description",
+}
+
+// applyOperationFilter добавляет условия фильтра операций; запрос должен содержать алиасы o, c и f
+func (fb *filterBuilder) applyOperationFilter(f *model.OperationFilter) error {
+	if f.StartTime != nil {
+		fb.add("o.operation_at >= " + fb.arg(*f.StartTime))
+	}
+	if f.EndTime != nil {
+		fb.add("o.operation_at <= " + fb.arg(*f.EndTime))
+	}
+	if len(f.Actors) > 0 {
+		fb.add("f.fam_member IN (" + fb.in(f.Actors) + ")")
+	}
+	if len(f.Categories) > 0 {
+		fb.add("c.cat_name IN (" + fb.in(f.Categories) + ")")
+	}
+	if f.Type != nil {
+		fb.add("o.type = " + fb.arg(*f.Type))
+	}
+	if f.Description != nil {
+		fb.add("o.description ILIKE " + fb.arg(filterql.ContainsPattern(*f.Description)))
+	}
+	// расходы хранятся с минусом, а границы суммы задаются так же, как сумма при создании - по модулю
+	if f.AmountMin != nil {
+		fb.add("ABS(o.amount) >= " + fb.arg(*f.AmountMin))
+	}
+	if f.AmountMax != nil {
+		fb.add("ABS(o.amount) <= " + fb.arg(*f.AmountMax))
+	}
+	// операция подходит, если у нее есть хотя бы одна из меток - пересечение массивов идет по GIN-индексу
+	if len(f.Tags) > 0 {
+		fb.add("o.tags && ARRAY[" + fb.in(f.Tags) + "]::text[]")
+	}
+	if len(f.Accounts) > 0 {
+		fb.add("o.account IN (" + fb.in(f.Accounts) + ")")
+	}
+	if f.Query != nil {
+		node, err := filterql.Parse(*f.Query)
+		if err != nil {
+			return err
+		}
+		cond, err := filterql.Compile(node, filterColumns, fb.arg)
+		if err != nil {
+			return err
+		}
+		fb.add(cond)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+func TestApplyOperationFilter(t *testing.T) {
+	desc, amountMin, query := "uber", int64(100000), "amount < -1000"
+
+	tests := []struct {
+		name      string
+		filter    model.OperationFilter
+		preArgs   []any
+		wantWhere string
+		wantArgs  []any
+	}{
+		{
+			name:      "empty",
+			wantWhere: "",
+			wantArgs:  nil,
+		},
+		{
+			name:      "tags and accounts",
+			filter:    model.OperationFilter{Tags: []string{"trip", "work"}, Accounts: []string{"card"}},
+			wantWhere: "WHERE o.tags && ARRAY[$1, $2]::text[] AND o.account IN ($3)",
+			wantArgs:  []any{"trip", "work", "card"},
+		},
+		{
+			name:      "numbering continues after query args",
+			filter:    model.OperationFilter{Actors: []string{"son"}, Tags: []string{"school"}},
+			preArgs:   []any{"new-actor", nil},
+			wantWhere: "WHERE f.fam_member IN ($3) AND o.tags && ARRAY[$4]::text[]",
+			wantArgs:  []any{"new-actor", nil, "son", "school"},
+		},
+		{
+			name:      "description, amount and query",
+			filter:    model.OperationFilter{Description: &desc, AmountMin: &amountMin, Query: &query},
+			wantWhere: "WHERE o.description ILIKE $1 AND ABS(o.amount) >= $2 AND o.amount < $3",
+			wantArgs:  []any{"%uber%", int64(100000), int64(-1000)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fb := newFilterBuilder(tt.preArgs...)
+			if err := fb.applyOperationFilter(&tt.filter); err != nil {
+				t.Fatal(err)
+			}
+			if got := fb.where(); got != tt.wantWhere {
+				t.Errorf("where = %q, want %q", got, tt.wantWhere)
+			}
+			if !slices.Equal(fb.args, tt.wantArgs) {
+				t.Errorf("args = %v, want %v", fb.args, tt.wantArgs)
+			}
+		})
+	}
+}
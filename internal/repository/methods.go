@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,21 +16,105 @@ import (
 )
 
 type PostgresRepo struct {
-	db *dbpg.DB
+	db    *dbpg.DB
+	tx    *sql.Tx // не nil, если экземпляр репо работает внутри транзакции
+	depth int     // уровень вложенности InTx - для имен savepoint'ов
+}
+
+// querier - общий набор методов *dbpg.DB и *sql.Tx: одни и те же запросы работают и вне, и внутри транзакции
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (pr *PostgresRepo) conn() querier {
+	if pr.tx != nil {
+		return pr.tx
+	}
+	return pr.db
+}
+
+func (pr *PostgresRepo) InTx(ctx context.Context, fn func(repo OperationsRepository) error) error {
+	if pr.tx != nil { // вложенный вызов - изолируем через savepoint, чтобы ошибка не ломала внешнюю транзакцию
+		return pr.inSavepoint(ctx, fn)
+	}
+
+	tx, err := pr.db.Master.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&PostgresRepo{db: pr.db, tx: tx, depth: 1}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("Failed to rollback transaction: %q", rbErr.Error())
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (pr *PostgresRepo) inSavepoint(ctx context.Context, fn func(repo OperationsRepository) error) error {
+	name := fmt.Sprintf("sp_%d", pr.depth)
+	if _, err := pr.tx.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+
+	if err := fn(&PostgresRepo{db: pr.db, tx: pr.tx, depth: pr.depth + 1}); err != nil {
+		if _, rbErr := pr.tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name); rbErr != nil {
+			log.Printf("Failed to rollback to savepoint %s: %q", name, rbErr.Error())
+		}
+		return err
+	}
+
+	_, err := pr.tx.ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
+}
+
+// inSnapshot выполняет чтения в одной read-only транзакции REPEATABLE READ, чтобы все запросы видели один снимок данных.
+// Внутри уже открытой транзакции снимок определяется ею
+func (pr *PostgresRepo) inSnapshot(ctx context.Context, fn func(repo *PostgresRepo) error) error {
+	if pr.tx != nil {
+		return fn(pr)
+	}
+
+	tx, err := pr.db.Master.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+
+	if err := fn(&PostgresRepo{db: pr.db, tx: tx, depth: 1}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			log.Printf("Failed to rollback transaction: %q", rbErr.Error())
+		}
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func (pr *PostgresRepo) Create(ctx context.Context, op *model.Operation) error {
-	query := `INSERT INTO operations (amount, actor_id, category_id, type, operation_at, description)
+	query := fmt.Sprintf(`WITH inserted AS (
+	INSERT INTO operations (amount, actor_id, category_id, type, operation_at, description, tags, account)
 	VALUES (
     $1,
     (SELECT id FROM family_members WHERE fam_member = $2),
     (SELECT id FROM category WHERE cat_name = $3),
     $4,
     $5,
-    $6);`
+    $6,
+    string_to_array($7, ','),
+    $8)
+	RETURNING id, amount, actor_id, category_id, type, operation_at, created_at, description, tags, account)
+	SELECT %s 
+	FROM inserted o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id;`, operationColumns)
 
-	_, err := pr.db.ExecContext(ctx, query, op.Amount, op.Actor, op.Category, op.Type, op.OperationAt, op.Description)
-	if err != nil {
+	// вставленная строка возвращается целиком - со сгенерированными ID и created_at
+	row := pr.conn().QueryRowContext(ctx, query, op.Amount, op.Actor, op.Category, op.Type, op.OperationAt, op.Description, strings.Join(op.Tags, ","), op.Account)
+	if err := scanOperation(row, op); err != nil {
 		switch {
 		case strings.Contains(err.Error(), "null value in column"):
 			return model.ErrUnknownActorOrCategory
@@ -40,22 +127,30 @@ func (pr *PostgresRepo) Create(ctx context.Context, op *model.Operation) error {
 }
 
 func (pr *PostgresRepo) Get(ctx context.Context, id int) (*model.Operation, error) {
-	query := `SELECT o.id, o.amount, f.fam_member, c.cat_name, o.type, o.operation_at, o.created_at, o.description 
+	return pr.getOperation(ctx, getOperationQuery(false), id)
+}
+
+// GetForUpdate читает операцию и блокирует ее строку до конца транзакции - вызывается внутри InTx
+func (pr *PostgresRepo) GetForUpdate(ctx context.Context, id int) (*model.Operation, error) {
+	return pr.getOperation(ctx, getOperationQuery(true), id)
+}
+
+func getOperationQuery(forUpdate bool) string {
+	query := fmt.Sprintf(`SELECT %s 
 	FROM operations o 
 	LEFT JOIN category c ON c.id = o.category_id 
 	LEFT JOIN family_members f ON f.id = o.actor_id 
-	WHERE o.id = $1`
+	WHERE o.id = $1`, operationColumns)
+	if forUpdate {
+		// блокируем только строку операции: справочники по LEFT JOIN заблокировать нельзя, да и не нужно
+		query += " FOR UPDATE OF o"
+	}
+	return query
+}
 
+func (pr *PostgresRepo) getOperation(ctx context.Context, query string, id int) (*model.Operation, error) {
 	var result model.Operation
-	if err := pr.db.QueryRowContext(ctx, query, id).Scan(
-		&result.ID,
-		&result.Amount,
-		&result.Actor,
-		&result.Category,
-		&result.Type,
-		&result.OperationAt,
-		&result.CreatedAt,
-		&result.Description); err != nil {
+	if err := scanOperation(pr.conn().QueryRowContext(ctx, query, id), &result); err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, model.ErrOperationIDNotFound
@@ -68,45 +163,191 @@ func (pr *PostgresRepo) Get(ctx context.Context, id int) (*model.Operation, erro
 }
 
 func (pr *PostgresRepo) List(ctx context.Context, f *model.RequestParamOperations) ([]model.Operation, error) {
-	periodExpr := definePeriodExpr(f.StartTime, f.EndTime)
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
 	limofExpr := defineLimitOffsetExpr(f.Limit, f.Page)
-	orderExpr, err := defineOrderExpr(f.OrderBy, f.ASC, f.DESC)
+	terms, err := defineSortTerms(f.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT %s 
+	FROM operations o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id
+	%s
+	%s
+	%s`, operationColumns, fb.where(), orderByExpr(terms, false), limofExpr)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanOperationRows(rows)
+}
+
+func (pr *PostgresRepo) ListEnvelope(ctx context.Context, f *model.RequestParamOperations) (*model.OperationsEnvelope, error) {
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+
+	totalsQuery := fmt.Sprintf(`SELECT COUNT(*), COALESCE(SUM(o.amount), 0) 
+	FROM operations o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id
+	%s`, fb.where())
+
+	result := &model.OperationsEnvelope{Page: *f.Page, Limit: *f.Limit}
+
+	// страница и итоги из одного снимка - иначе total_count может разойтись с items при параллельной записи
+	err := pr.inSnapshot(ctx, func(repo *PostgresRepo) error {
+		items, err := repo.List(ctx, f)
+		if err != nil {
+			return err
+		}
+		result.Items = items
+
+		return repo.conn().QueryRowContext(ctx, totalsQuery, fb.args...).Scan(&result.TotalCount, &result.TotalAmount)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.HasMore = int64(result.Page)*int64(result.Limit) < result.TotalCount
+	return result, nil
+}
+
+func (pr *PostgresRepo) ListPage(ctx context.Context, f *model.RequestParamOperations) (*model.OperationsPage, error) {
+	terms, err := defineSortTerms(f.Sort)
+	if err != nil {
+		return nil, err
+	}
+	limit := model.DefaultPageLimit
+	if f.Limit != nil {
+		limit = *f.Limit
+	}
+
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+	filterWhere, filterArgs := fb.where(), append([]any(nil), fb.args...) // для total_count - без условия курсора
+
+	// страница "назад" выбирается в обратном порядке и потом разворачивается
+	var cursor *cursorToken
+	if f.Cursor != nil {
+		if cursor, err = decodeCursor(*f.Cursor, f.Sort, terms); err != nil {
+			return nil, err
+		}
+		fb.keysetCond(terms, cursor.Values, cursor.Prev)
+	}
+	reverse := cursor != nil && cursor.Prev
+
+	// берем на одну строку больше, чтобы понять, есть ли следующая страница
+	query := fmt.Sprintf(`SELECT %s 
+	FROM operations o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id
+	%s
+	%s
+	LIMIT %d`, operationColumns, fb.where(), orderByExpr(terms, reverse), limit+1)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
 	if err != nil {
 		return nil, err
 	}
+	items, err := scanOperationRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+	if reverse {
+		slices.Reverse(items)
+	}
+
+	result := &model.OperationsPage{Items: items}
+	if len(items) > 0 {
+		// вперед можно идти, если за страницей есть строки или если мы пришли на нее "назад";
+		// назад - если пришли по курсору "вперед" или перед страницей есть строки
+		if (!reverse && hasMore) || reverse {
+			next := encodeCursor(f.Sort, terms, &items[len(items)-1], false)
+			result.NextCursor = &next
+		}
+		if (reverse && hasMore) || (!reverse && cursor != nil) {
+			prev := encodeCursor(f.Sort, terms, &items[0], true)
+			result.PrevCursor = &prev
+		}
+	}
+
+	if f.WithTotal {
+		countQuery := fmt.Sprintf(`SELECT COUNT(*) 
+		FROM operations o 
+		LEFT JOIN category c ON c.id = o.category_id 
+		LEFT JOIN family_members f ON f.id = o.actor_id
+		%s`, filterWhere)
+
+		var total int64
+		if err := pr.conn().QueryRowContext(ctx, countQuery, filterArgs...).Scan(&total); err != nil {
+			return nil, err
+		}
+		result.TotalCount = &total
+	}
+
+	return result, nil
+}
+
+func (pr *PostgresRepo) Search(ctx context.Context, f *model.RequestParamSearch) ([]model.SearchHit, error) {
+	// $1 - tsquery с префиксным совпадением по каждому слову, фильтры продолжают нумерацию
+	fb := newFilterBuilder(buildPrefixTSQuery(f.Terms))
+	fb.add("o.description_tsv @@ query")
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+	limofExpr := defineLimitOffsetExpr(f.Limit, f.Page)
+	orderExpr := "ORDER BY rank DESC, o.operation_at DESC, o.id DESC" // по умолчанию - самые релевантные сверху
+	if len(f.Sort) > 0 {
+		terms, err := defineSortTerms(f.Sort)
+		if err != nil {
+			return nil, err
+		}
+		orderExpr = orderByExpr(terms, false)
+	}
 
-	query := fmt.Sprintf(`SELECT o.id, o.amount, f.fam_member, c.cat_name, o.type, o.operation_at, o.created_at, o.description 
+	query := fmt.Sprintf(`SELECT %s,
+	ts_rank(o.description_tsv, query)::float8 AS rank,
+	ts_headline('russian', coalesce(o.description, ''), query, 'StartSel=<b>, StopSel=</b>, MaxFragments=2, MinWords=5, MaxWords=15')
 	FROM operations o 
 	LEFT JOIN category c ON c.id = o.category_id 
 	LEFT JOIN family_members f ON f.id = o.actor_id
+	CROSS JOIN to_tsquery('russian', $1) AS query
 	%s
 	%s
-	%s`, periodExpr, orderExpr, limofExpr)
+	%s`, operationColumns, fb.where(), orderExpr, limofExpr)
 
-	rows, err := pr.db.QueryContext(ctx, query)
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	result := make([]model.Operation, 0)
+	result := make([]model.SearchHit, 0)
 	for rows.Next() {
-		item := model.Operation{}
-		if err := rows.Scan(
-			&item.ID,
-			&item.Amount,
-			&item.Actor,
-			&item.Category,
-			&item.Type,
-			&item.OperationAt,
-			&item.CreatedAt,
-			&item.Description); err != nil {
+		item := model.SearchHit{}
+		if err := scanOperation(rows, &item.Operation, &item.Rank, &item.Snippet); err != nil {
 			return nil, err
 		}
 		result = append(result, item)
 	}
 
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
@@ -114,16 +355,25 @@ func (pr *PostgresRepo) List(ctx context.Context, f *model.RequestParamOperation
 }
 
 func (pr *PostgresRepo) Update(ctx context.Context, op *model.Operation) error {
-	query := `UPDATE operations SET 
+	query := fmt.Sprintf(`WITH updated AS (
+	UPDATE operations SET 
 	amount = $2, 
 	actor_id = (SELECT id FROM family_members WHERE fam_member = $3), 
 	category_id = (SELECT id FROM category WHERE cat_name = $4), 
 	type = $5, 
 	operation_at = $6, 
-	description = $7 
-	WHERE id = $1;`
+	description = $7, 
+	tags = string_to_array($8, ','), 
+	account = $9 
+	WHERE id = $1
+	RETURNING id, amount, actor_id, category_id, type, operation_at, created_at, description, tags, account)
+	SELECT %s 
+	FROM updated o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id;`, operationColumns)
 
-	row, err := pr.db.ExecContext(ctx,
+	// обновленная строка возвращается целиком
+	row := pr.conn().QueryRowContext(ctx,
 		query,
 		op.ID,
 		op.Amount,
@@ -131,9 +381,13 @@ func (pr *PostgresRepo) Update(ctx context.Context, op *model.Operation) error {
 		op.Category,
 		op.Type,
 		op.OperationAt,
-		op.Description)
-	if err != nil {
+		op.Description,
+		strings.Join(op.Tags, ","),
+		op.Account)
+	if err := scanOperation(row, op); err != nil {
 		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return model.ErrOperationIDNotFound
 		case strings.Contains(err.Error(), "null value"):
 			return model.ErrUnknownActorOrCategory
 		default:
@@ -141,6 +395,17 @@ func (pr *PostgresRepo) Update(ctx context.Context, op *model.Operation) error {
 		}
 	}
 
+	return nil
+}
+
+func (pr *PostgresRepo) Delete(ctx context.Context, id int) error {
+	query := `DELETE FROM operations WHERE id = $1`
+
+	row, err := pr.conn().ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
 	rows, _ := row.RowsAffected()
 	if rows == 0 {
 		return model.ErrOperationIDNotFound
@@ -149,45 +414,209 @@ func (pr *PostgresRepo) Update(ctx context.Context, op *model.Operation) error {
 	return nil
 }
 
-func (pr *PostgresRepo) Delete(ctx context.Context, id int) error {
-	query := `DELETE FROM operations WHERE id = $1`
+func (pr *PostgresRepo) BulkUpdatePreview(ctx context.Context, f *model.OperationFilter, limit int) (int64, []model.Operation, error) {
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(f); err != nil {
+		return 0, nil, err
+	}
+
+	countQuery := fmt.Sprintf(`SELECT COUNT(*) 
+	FROM operations o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id
+	%s`, fb.where())
+
+	var matched int64
+	if err := pr.conn().QueryRowContext(ctx, countQuery, fb.args...).Scan(&matched); err != nil {
+		return 0, nil, err
+	}
+
+	previewQuery := fmt.Sprintf(`SELECT %s 
+	FROM operations o 
+	LEFT JOIN category c ON c.id = o.category_id 
+	LEFT JOIN family_members f ON f.id = o.actor_id
+	%s
+	ORDER BY o.operation_at DESC, o.id DESC
+	LIMIT %d`, operationColumns, fb.where(), limit)
+
+	rows, err := pr.conn().QueryContext(ctx, previewQuery, fb.args...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	preview, err := scanOperationRows(rows)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return matched, preview, nil
+}
+
+func (pr *PostgresRepo) BulkUpdate(ctx context.Context, f *model.OperationFilter, set *model.BulkUpdateSet) (int64, error) {
+	// $1 и $2 - новые значения, $3 и $4 - добавляемые и снимаемые метки через запятую, фильтр продолжает нумерацию
+	fb := newFilterBuilder(set.Actor, set.Category, strings.Join(set.AddTags, ","), strings.Join(set.RemoveTags, ","))
+	if err := fb.applyOperationFilter(f); err != nil {
+		return 0, err
+	}
+
+	// один UPDATE по фильтру, старые и новые значения каждой строки пишутся в историю тем же запросом
+	query := fmt.Sprintf(`WITH target AS (
+		SELECT o.id, f.fam_member AS old_actor, c.cat_name AS old_category, o.tags AS old_tags 
+		FROM operations o 
+		LEFT JOIN category c ON c.id = o.category_id 
+		LEFT JOIN family_members f ON f.id = o.actor_id
+		%s
+		FOR UPDATE OF o
+	), updated AS (
+		UPDATE operations o SET 
+		actor_id = CASE WHEN $1::text IS NULL THEN o.actor_id ELSE (SELECT id FROM family_members WHERE fam_member = $1) END,
+		category_id = CASE WHEN $2::text IS NULL THEN o.category_id ELSE (SELECT id FROM category WHERE cat_name = $2) END,
+		-- новые метки дописываются в конец, снятые убираются, порядок остальных сохраняется
+		tags = CASE WHEN $3::text = '' AND $4::text = '' THEN o.tags ELSE ARRAY(
+			SELECT x.tag FROM unnest(o.tags || string_to_array($3, ',')) WITH ORDINALITY AS x(tag, n)
+			WHERE x.tag <> ALL (string_to_array($4, ','))
+			GROUP BY x.tag 
+			ORDER BY MIN(x.n)) END
+		FROM target t 
+		WHERE o.id = t.id
+		RETURNING o.id, o.actor_id, o.category_id, o.tags
+	), history AS (
+		INSERT INTO operations_history (operation_id, action, old_data, new_data)
+		SELECT u.id, 'bulk_update',
+		jsonb_build_object('actor', t.old_actor, 'category', t.old_category, 'tags', t.old_tags),
+		jsonb_build_object('actor', f.fam_member, 'category', c.cat_name, 'tags', u.tags)
+		FROM updated u 
+		JOIN target t ON t.id = u.id 
+		LEFT JOIN category c ON c.id = u.category_id 
+		LEFT JOIN family_members f ON f.id = u.actor_id
+	)
+	SELECT COUNT(*) FROM updated`, fb.where())
+
+	var updated int64
+	if err := pr.conn().QueryRowContext(ctx, query, fb.args...).Scan(&updated); err != nil {
+		// после добавления меток у операции их оказалось больше лимита
+		if strings.Contains(err.Error(), "chk_operations_tags") {
+			return 0, model.ErrInvalidTags
+		}
+		return 0, err
+	}
+
+	return updated, nil
+}
+
+func (pr *PostgresRepo) GetIdempotencyKey(ctx context.Context, key string, ttl time.Duration) (*model.IdempotencyRecord, error) {
+	query := `SELECT idem_key, request_hash, operation_id, response_status, response_body, created_at 
+	FROM idempotency_keys 
+	WHERE idem_key = $1 AND created_at >= now() - make_interval(secs => $2)`
+
+	var result model.IdempotencyRecord
+	var status sql.NullInt64
+	var body []byte
+	if err := pr.conn().QueryRowContext(ctx, query, key, ttl.Seconds()).Scan(
+		&result.Key,
+		&result.RequestHash,
+		&result.OperationID,
+		&status,
+		&body,
+		&result.CreatedAt); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, model.ErrIdempotencyKeyNotFound
+		default:
+			return nil, err
+		}
+	}
+	if status.Valid && body != nil {
+		result.Response = &model.IdempotentResponse{Status: int(status.Int64), Body: body}
+	}
+
+	return &result, nil
+}
+
+func (pr *PostgresRepo) SaveIdempotencyKey(ctx context.Context, rec *model.IdempotencyRecord, ttl time.Duration) error {
+	// попутно чистим ключи с истекшим окном
+	if _, err := pr.conn().ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < now() - make_interval(secs => $1)`, ttl.Seconds()); err != nil {
+		return err
+	}
 
-	row, err := pr.db.ExecContext(ctx, query, id)
+	// если живой ключ уже есть (в т.ч. только что сохранен параллельным запросом) - ничего не вставится
+	query := `INSERT INTO idempotency_keys (idem_key, request_hash, operation_id, response_status, response_body) 
+	VALUES ($1, $2, $3, $4, $5) 
+	ON CONFLICT (idem_key) DO NOTHING`
+
+	var status *int
+	var body *string
+	if rec.Response != nil {
+		text := string(rec.Response.Body)
+		status, body = &rec.Response.Status, &text
+	}
+	row, err := pr.conn().ExecContext(ctx, query, rec.Key, rec.RequestHash, rec.OperationID, status, body)
 	if err != nil {
 		return err
 	}
 
 	rows, _ := row.RowsAffected()
 	if rows == 0 {
-		return model.ErrOperationIDNotFound
+		return model.ErrIdempotencyKeyExists
 	}
 
 	return nil
 }
 
 func (pr *PostgresRepo) AnalyticsGroup(ctx context.Context, f *model.RequestParamAnalytics) ([]model.AnalyticsQuantum, error) {
-	groupExpr, err := defineGroupExpr(f.GroupBy)
+	if len(f.Dimensions) == 0 {
+		return nil, model.ErrInvalidGroupBy
+	}
+	groupExprs := make([]string, 0, len(f.Dimensions))
+	keyExprs := make([]string, 0, len(f.Dimensions))
+	for _, dim := range f.Dimensions {
+		expr, err := defineGroupExpr(dim, f.TimeBuckets)
+		if err != nil {
+			return nil, err
+		}
+		groupExprs = append(groupExprs, expr)
+		keyExprs = append(keyExprs, defineGroupKeyExpr(dim, expr))
+	}
+	groupExpr := strings.Join(groupExprs, ", ")
+	limitOffsetExpr := defineLimitOffsetExpr(f.Limit, f.Page)
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+
+	extraExpr, err := defineExtraStatsExpr(f.ExtraStats)
 	if err != nil {
 		return nil, err
 	}
-	limitOffsetExpr := defineLimitOffsetExpr(f.Limit, f.Page)
-	periodExpr := definePeriodExpr(f.StartTime, f.EndTime)
-
-	query := fmt.Sprintf(`SELECT %s AS group_key,
-       SUM(amount)::float8,
-       AVG(amount)::float8,
-       COUNT(*),
-	   percentile_cont(0.5) WITHIN GROUP (ORDER BY amount)::float8,
-	   percentile_cont(0.9) WITHIN GROUP (ORDER BY amount)::float8
+
+	query := fmt.Sprintf(`SELECT %s,
+	   %s%s
 	   FROM operations o 
 	   LEFT JOIN category c ON c.id = o.category_id 
 	   LEFT JOIN family_members f ON f.id = o.actor_id
 	   %s
 	   GROUP BY %s
 	   ORDER BY %s
-	   %s`, groupExpr, periodExpr, groupExpr, groupExpr, limitOffsetExpr)
+	   %s`, strings.Join(keyExprs, ", "), analyticsSectionsExpr, extraExpr, fb.where(), groupExpr, groupExpr, limitOffsetExpr)
+
+	if f.Fill != nil && *f.Fill != model.FillNone {
+		// интервалы берутся из generate_series, а операции присоединяются к ним - пустые интервалы остаются в выборке.
+		// Фильтр переезжает из WHERE в условие JOIN, иначе он отбросит пустые интервалы
+		unit := timeBucketUnits[f.Dimensions[0]]
+		query = fmt.Sprintf(`SELECT to_char(b.bucket, 'YYYY-MM-DD'),
+	   %s%s
+	   FROM generate_series(%s, %s::timestamptz AT TIME ZONE %s, '1 %s'::interval) AS b(bucket)
+	   LEFT JOIN (operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id)
+	   ON %s = b.bucket AND %s
+	   GROUP BY b.bucket
+	   ORDER BY b.bucket
+	   %s`, analyticsSectionsExpr, extraExpr, defineBucketExpr(unit, fb.arg(*f.StartTime)+"::timestamptz", f.TimeBuckets),
+			fb.arg(*f.EndTime), quoteLiteral(timeZoneName(f.TimeBuckets)), unit, groupExpr, fb.condition(), limitOffsetExpr)
+	}
 
-	rows, err := pr.db.QueryContext(ctx, query)
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
 	if err != nil {
 		return nil, err
 	}
@@ -196,9 +625,31 @@ func (pr *PostgresRepo) AnalyticsGroup(ctx context.Context, f *model.RequestPara
 	result := make([]model.AnalyticsQuantum, 0)
 	for rows.Next() {
 		var item model.AnalyticsQuantum
-		if err := rows.Scan(&item.Key, &item.Sum, &item.Avg, &item.Count, &item.Median, &item.P90); err != nil {
+		// значения измерений идут первыми колонками; NULL (удаленный актор/категория) - пустая строка
+		keys := make([]sql.NullString, len(f.Dimensions))
+		extras := make([]float64, len(analyticsSections)*len(f.ExtraStats))
+		dest := make([]any, 0, len(keys)+15+len(extras))
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		dest = append(dest, analyticsSectionsDest(&item.Net, &item.Income, &item.Expense)...)
+		for i := range extras {
+			dest = append(dest, &extras[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
+		assignExtraStats(f.ExtraStats, extras, &item.Net, &item.Income, &item.Expense)
+		item.Stats = item.Net.Stats
+		item.Sum, item.Avg, item.Count, item.Median, item.P90 = item.Net.Sum, item.Net.Avg, item.Net.Count, item.Net.Median, item.Net.P90
+
+		item.Keys = make(map[string]string, len(keys))
+		values := make([]string, 0, len(keys))
+		for i, dim := range f.Dimensions {
+			item.Keys[dim] = keys[i].String
+			values = append(values, keys[i].String)
+		}
+		item.Key = strings.Join(values, model.GroupKeySeparator)
 		result = append(result, item)
 	}
 	if rows.Err() != nil {
@@ -209,127 +660,775 @@ func (pr *PostgresRepo) AnalyticsGroup(ctx context.Context, f *model.RequestPara
 }
 
 func (pr *PostgresRepo) AnalyticsSummary(ctx context.Context, f *model.RequestParamAnalytics) (*model.AnalyticsSummary, error) {
-	periodExpr := definePeriodExpr(f.StartTime, f.EndTime)
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+	// на пустой выборке агрегаты вернут NULL - для итогов это нули
+	extraExpr, err := defineExtraStatsExpr(f.ExtraStats)
+	if err != nil {
+		return nil, err
+	}
+
 	query := fmt.Sprintf(`SELECT
-       SUM(amount)::float8,
-       AVG(amount)::float8,
-       COUNT(*),
-	   percentile_cont(0.5) WITHIN GROUP (ORDER BY amount)::float8,
-	   percentile_cont(0.9) WITHIN GROUP (ORDER BY amount)::float8
-	   FROM operations
-	   %s`, periodExpr)
+	   %s%s
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   %s`, analyticsSectionsExpr, extraExpr, fb.where())
 
 	var result model.AnalyticsSummary
-	if err := pr.db.QueryRowContext(ctx, query).Scan(
-		&result.Sum,
-		&result.Avg,
-		&result.Count,
-		&result.Median,
-		&result.P90); err != nil {
+	extras := make([]float64, len(analyticsSections)*len(f.ExtraStats))
+	dest := analyticsSectionsDest(&result.Net, &result.Income, &result.Expense)
+	for i := range extras {
+		dest = append(dest, &extras[i])
+	}
+	if err := pr.conn().QueryRowContext(ctx, query, fb.args...).Scan(dest...); err != nil {
 		return nil, err
 	}
+	assignExtraStats(f.ExtraStats, extras, &result.Net, &result.Income, &result.Expense)
+	result.Stats = result.Net.Stats
+	result.Sum, result.Avg, result.Count, result.Median, result.P90 = result.Net.Sum, result.Net.Avg, result.Net.Count, result.Net.Median, result.Net.P90
 
 	return &result, nil
 }
 
-func defineGroupExpr(input *string) (string, error) {
-	if input == nil {
-		return "", model.ErrInvalidGroupBy
-	}
-
-	switch *input {
-	case model.GroupByDay:
-		return "date_trunc('day', operation_at)", nil
-	case model.GroupByWeek:
-		return "date_trunc('week', operation_at)", nil
-	case model.GroupByMonth:
-		return "date_trunc('month', operation_at)", nil
-	case model.GroupByYear:
-		return "date_trunc('year', operation_at)", nil
-	case model.GroupByActor:
-		return "f.fam_member", nil
-	case model.GroupByCategory:
-		return "c.cat_name", nil
-	case model.GroupByOpType:
-		return "o.type", nil
-	default:
-		return "", model.ErrInvalidGroupBy
+func (pr *PostgresRepo) AnalyticsPivot(ctx context.Context, f *model.RequestParamPivot) ([]model.PivotCell, error) {
+	rowExpr, err := defineGroupExpr(*f.Rows, f.TimeBuckets)
+	if err != nil {
+		return nil, err
 	}
-}
-
-func defineLimitOffsetExpr(lim, p *int) string {
-	if lim == nil && p == nil { // оба значения нил - вообще не применяем их к квери
-		return ""
+	colExpr, err := defineGroupExpr(*f.Cols, f.TimeBuckets)
+	if err != nil {
+		return nil, err
 	}
-
-	// избавляемся от указателей
-	var limit, page int
-	if lim != nil {
-		limit = *lim
+	metricExpr, err := defineMetricExpr(*f.Metric)
+	if err != nil {
+		return nil, err
 	}
-	if p != nil {
-		page = *p
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
 	}
 
-	if limit <= 0 { // задаем значение по умолчанию если лимит пуст/некорректен
-		limit = 20
-	}
+	// ячейки, итоги по строкам, по колонкам и общий итог - за один проход;
+	// GROUPING отличает свернутое измерение от настоящего NULL (удаленный актор/категория)
+	query := fmt.Sprintf(`SELECT %s AS row_key, %s AS col_key,
+	   GROUPING(%s) = 1 AS col_total,
+	   GROUPING(%s) = 1 AS row_total,
+	   %s
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   %s
+	   GROUP BY GROUPING SETS ((%s, %s), (%s), (%s), ())
+	   ORDER BY 1, 2`, defineGroupKeyExpr(*f.Rows, rowExpr), defineGroupKeyExpr(*f.Cols, colExpr), rowExpr, colExpr, metricExpr, fb.where(), rowExpr, colExpr, rowExpr, colExpr)
 
-	if limit > 1000 { // защита от слишком больших значений
-		limit = 1000
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if page <= 0 { // если страница имеет некорректное значение - ставим 1
-		page = 1
+	result := make([]model.PivotCell, 0)
+	for rows.Next() {
+		var item model.PivotCell
+		var rowKey, colKey sql.NullString
+		var value sql.NullFloat64
+		if err := rows.Scan(&rowKey, &colKey, &item.ColTotal, &item.RowTotal, &value); err != nil {
+			return nil, err
+		}
+		item.Row, item.Col = rowKey.String, colKey.String
+		if value.Valid {
+			item.Value = &value.Float64
+		}
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
 	}
 
-	// оба значения корректны - добавляем в квери
-	offset := limit * (page - 1)
-	return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+	return result, nil
 }
 
-func defineOrderExpr(orderBy *string, asc, desc bool) (string, error) {
-	if orderBy == nil {
-		return "", nil
+func (pr *PostgresRepo) AnalyticsCashflow(ctx context.Context, f *model.RequestParamCashflow) ([]model.CashflowBucket, error) {
+	unit, ok := timeBucketUnits[*f.Interval]
+	if !ok {
+		return nil, model.ErrInvalidInterval
+	}
+	bucketExpr := defineBucketExpr(unit, "o.operation_at", f.TimeBuckets)
+	// $1 - остаток на начало, фильтры продолжают нумерацию
+	fb := newFilterBuilder(*f.OpeningBalance)
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+
+	// границы ряда - интервалы from и to, без них - первый и последний интервал с операциями
+	fromBucket, toBucket := "NULL::timestamp", "NULL::timestamp"
+	if f.StartTime != nil {
+		fromBucket = defineBucketExpr(unit, fb.arg(*f.StartTime)+"::timestamptz", f.TimeBuckets)
 	}
+	if f.EndTime != nil {
+		toBucket = defineBucketExpr(unit, fb.arg(*f.EndTime)+"::timestamptz", f.TimeBuckets)
+	}
+
+	// сначала потоки по интервалам, затем каждый интервал ряда из generate_series - пустые с нулевыми потоками,
+	// и нарастающий остаток оконной суммой по упорядоченным интервалам
+	query := fmt.Sprintf(`WITH t AS (
+	   SELECT %s AS bucket,
+	   COALESCE(SUM(o.amount) FILTER (WHERE o.type = '%s'), 0)::bigint AS inflow,
+	   COALESCE(SUM(ABS(o.amount)) FILTER (WHERE o.type = '%s'), 0)::bigint AS outflow,
+	   SUM(o.amount)::bigint AS net
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   %s
+	   GROUP BY 1),
+	   bounds AS (
+	   SELECT COALESCE(%s, MIN(bucket)) AS lo, COALESCE(%s, MAX(bucket)) AS hi FROM t)
+	   SELECT to_char(b.bucket, 'YYYY-MM-DD'), COALESCE(t.inflow, 0), COALESCE(t.outflow, 0), COALESCE(t.net, 0),
+	   ($1::bigint + SUM(COALESCE(t.net, 0)) OVER (ORDER BY b.bucket))::bigint
+	   FROM bounds
+	   CROSS JOIN generate_series(bounds.lo, bounds.hi, '1 %s'::interval) AS b(bucket)
+	   LEFT JOIN t ON t.bucket = b.bucket
+	   ORDER BY b.bucket`, bucketExpr, model.OpTypeDebit, model.OpTypeCredit, fb.where(), fromBucket, toBucket, unit)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	direction := ""
-	switch {
-	case asc == desc:
-		direction = "DESC" // значение по умолчанию
-	case asc:
-		direction = "ASC"
+	result := make([]model.CashflowBucket, 0)
+	for rows.Next() {
+		var item model.CashflowBucket
+		if err := rows.Scan(&item.Bucket, &item.Inflow, &item.Outflow, &item.Net, &item.Balance); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+func (pr *PostgresRepo) AnalyticsMonthlyByCategory(ctx context.Context, f *model.RequestParamForecast) ([]model.MonthlyAggregate, error) {
+	bucketExpr := defineBucketExpr(timeBucketUnits[model.GroupByMonth], "o.operation_at", f.TimeBuckets)
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT to_char(%s, 'YYYY-MM-DD'), COALESCE(c.cat_name, ''),
+	   COALESCE(SUM(o.amount) FILTER (WHERE o.type = '%s'), 0)::float8,
+	   COALESCE(SUM(ABS(o.amount)) FILTER (WHERE o.type = '%s'), 0)::float8
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   %s
+	   GROUP BY 1, 2
+	   ORDER BY 1, 2`, bucketExpr, model.OpTypeDebit, model.OpTypeCredit, fb.where())
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.MonthlyAggregate, 0)
+	for rows.Next() {
+		var item model.MonthlyAggregate
+		if err := rows.Scan(&item.Month, &item.Category, &item.Income, &item.Expense); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+// AnalyticsTop возвращает первые n групп по сумме (по модулю) вместе с итогами всей выборки - "прочие" считает сервис
+func (pr *PostgresRepo) AnalyticsTop(ctx context.Context, f *model.RequestParamTop) ([]model.TopGroup, error) {
+	var keyExpr string
+	switch *f.By {
+	case model.TopByDescription:
+		// описания сравниваются без учета регистра и пробелов по краям
+		keyExpr = "lower(btrim(o.description))"
 	default:
-		direction = "DESC"
-	}
-
-	switch *orderBy {
-	case model.OrderByActor:
-		return fmt.Sprintf("ORDER BY f.fam_member %s ", direction), nil
-	case model.OrderByAmount:
-		return fmt.Sprintf("ORDER BY o.amount %s ", direction), nil
-	case model.OrderByCategory:
-		return fmt.Sprintf("ORDER BY c.cat_name %s ", direction), nil
-	case model.OrderByOpDate:
-		return fmt.Sprintf("ORDER BY o.operation_at %s ", direction), nil
-	case model.OrderByOpID:
-		return fmt.Sprintf("ORDER BY o.id %s ", direction), nil
-	case model.OrderByType:
-		return fmt.Sprintf("ORDER BY o.type %s ", direction), nil
+		expr, err := defineGroupExpr(*f.By, f.TimeBuckets)
+		if err != nil {
+			return nil, err
+		}
+		keyExpr = expr
+	}
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+
+	// нарастающая сумма по рангу нужна и для pareto_groups - по всем группам, а не только по первым n
+	query := fmt.Sprintf(`WITH g AS (
+	   SELECT COALESCE(%s, '') AS key, SUM(ABS(o.amount))::float8 AS amount, COUNT(*) AS cnt
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   %s
+	   GROUP BY 1),
+	   r AS (
+	   SELECT key, amount, cnt,
+	   ROW_NUMBER() OVER (ORDER BY amount DESC, key) AS rn,
+	   SUM(amount) OVER (ORDER BY amount DESC, key ROWS UNBOUNDED PRECEDING) AS cum,
+	   SUM(amount) OVER () AS total_amount,
+	   SUM(cnt) OVER ()::bigint AS total_count,
+	   COUNT(*) OVER () AS groups
+	   FROM g),
+	   p AS (
+	   SELECT *, COUNT(*) FILTER (WHERE cum - amount < %s * total_amount) OVER () AS pareto
+	   FROM r)
+	   SELECT key, amount, cnt, total_amount, total_count, groups, pareto
+	   FROM p
+	   WHERE rn <= %d
+	   ORDER BY rn`, keyExpr, fb.where(), strconv.FormatFloat(model.ParetoShare, 'f', -1, 64), *f.N)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.TopGroup, 0, *f.N)
+	for rows.Next() {
+		var item model.TopGroup
+		if err := rows.Scan(&item.Key, &item.Amount, &item.Count, &item.TotalAmount, &item.TotalCount, &item.Groups, &item.Pareto); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+// AnalyticsHistogram раскладывает суммы операций по модулю на интервалы width_bucket: равной ширины между минимумом и
+// максимумом выборки или по заданным границам
+func (pr *PostgresRepo) AnalyticsHistogram(ctx context.Context, f *model.RequestParamHistogram) ([]model.HistogramCell, error) {
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&f.OperationFilter); err != nil {
+		return nil, err
+	}
+	categoryExpr := "''"
+	if f.ByCategory {
+		categoryExpr = "COALESCE(c.cat_name, '')"
+	}
+
+	// максимум попадает в интервал n+1 - возвращаем его в последний; при одной сумме в выборке ширина нулевая
+	bucketExpr := fmt.Sprintf("CASE WHEN b.hi > b.lo THEN LEAST(width_bucket(v.amount, b.lo, b.hi, %[1]d), %[1]d) ELSE 1 END", *f.Buckets)
+	if len(f.EdgeValues) > 0 {
+		edges := make([]string, 0, len(f.EdgeValues))
+		for _, e := range f.EdgeValues {
+			edges = append(edges, fb.arg(e)+"::float8")
+		}
+		// 0 - ниже первой границы, len(edges) - от последней и выше
+		bucketExpr = "width_bucket(v.amount, ARRAY[" + strings.Join(edges, ", ") + "])"
+	}
+
+	query := fmt.Sprintf(`WITH v AS (
+	   SELECT %s AS category, ABS(o.amount)::float8 AS amount
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   %s),
+	   b AS (
+	   SELECT MIN(amount) AS lo, MAX(amount) AS hi FROM v)
+	   SELECT v.category, %s AS bucket, COUNT(*), SUM(v.amount)::float8, b.lo, b.hi
+	   FROM v CROSS JOIN b
+	   GROUP BY v.category, 2, b.lo, b.hi
+	   ORDER BY v.category, 2`, categoryExpr, fb.where(), bucketExpr)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.HistogramCell, 0)
+	for rows.Next() {
+		var item model.HistogramCell
+		if err := rows.Scan(&item.Category, &item.Bucket, &item.Count, &item.Amount, &item.Min, &item.Max); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+// Anomalies ищет выбросы сумм, повторы и недельные всплески расходов категорий в одном снимке данных
+func (pr *PostgresRepo) Anomalies(ctx context.Context, f *model.RequestParamAnomalies) (*model.Anomalies, error) {
+	result := &model.Anomalies{From: *f.StartTime, To: *f.EndTime}
+
+	err := pr.inSnapshot(ctx, func(repo *PostgresRepo) error {
+		outliers, err := repo.amountOutliers(ctx, f)
+		if err != nil {
+			return err
+		}
+		duplicates, err := repo.duplicateOperations(ctx, f)
+		if err != nil {
+			return err
+		}
+		result.Operations = append(outliers, duplicates...)
+
+		result.Spikes, err = repo.categorySpikes(ctx, f)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// anomalyFilter - фильтры запроса без from/to: у каждого запроса аномалий свои временные границы
+func anomalyFilter(f *model.RequestParamAnomalies) (*filterBuilder, string, error) {
+	filter := f.OperationFilter
+	filter.StartTime, filter.EndTime = nil, nil
+	fb := newFilterBuilder()
+	if err := fb.applyOperationFilter(&filter); err != nil {
+		return nil, "", err
+	}
+	return fb, fb.condition(), nil
+}
+
+// amountOutliers - операции окна, сумма которых выше перцентиля или z-порога своей категории и типа за базовый период
+func (pr *PostgresRepo) amountOutliers(ctx context.Context, f *model.RequestParamAnomalies) ([]model.Anomaly, error) {
+	fb, cond, err := anomalyFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	baseFrom, from, to := fb.arg(f.BaselineFrom), fb.arg(*f.StartTime), fb.arg(*f.EndTime)
+	percentile, z := fb.arg(*f.Percentile/100), fb.arg(*f.ZScore)
+
+	// база считается до from - проверяемые операции не размывают собственный порог
+	query := fmt.Sprintf(`WITH base AS (
+	   SELECT o.category_id, o.type, COUNT(*) AS cnt,
+	   AVG(ABS(o.amount))::float8 AS avg,
+	   COALESCE(stddev_samp(ABS(o.amount)), 0)::float8 AS sd,
+	   percentile_cont(%[5]s::float8) WITHIN GROUP (ORDER BY ABS(o.amount))::float8 AS pct
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   WHERE %[1]s AND o.operation_at >= %[2]s AND o.operation_at < %[3]s
+	   GROUP BY o.category_id, o.type
+	   HAVING COUNT(*) >= %[7]d)
+	   SELECT %[9]s,
+	   b.cnt, b.avg, b.sd, b.pct, CASE WHEN b.sd > 0 THEN (ABS(o.amount) - b.avg) / b.sd END
+	   FROM operations o 
+	   JOIN base b ON b.category_id IS NOT DISTINCT FROM o.category_id AND b.type = o.type
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   WHERE %[1]s AND o.operation_at >= %[3]s AND o.operation_at <= %[4]s
+	   AND (ABS(o.amount) > b.pct OR (b.sd > 0 AND (ABS(o.amount) - b.avg) / b.sd > %[6]s::float8))
+	   ORDER BY o.operation_at DESC, o.id DESC
+	   LIMIT %[8]d`, cond, baseFrom, from, to, percentile, z, model.MinAnomalyBaseline, model.MaxAnomalies, operationColumns)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.Anomaly, 0)
+	for rows.Next() {
+		item := model.Anomaly{Reason: model.AnomalyAmountOutlier}
+		base := &model.AnomalyBaseline{From: f.BaselineFrom, To: *f.StartTime}
+		var z sql.NullFloat64 // NULL - в базе все суммы одинаковые
+		if err := scanOperation(rows, &item.Operation, &base.Count, &base.Avg, &base.Stddev, &base.Percentile, &z); err != nil {
+			return nil, err
+		}
+		if z.Valid {
+			item.ZScore = &z.Float64
+		}
+		item.Baseline = base
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+// duplicateOperations - операции окна, у которых незадолго до них есть такая же: сумма, тип, актор, категория и описание
+func (pr *PostgresRepo) duplicateOperations(ctx context.Context, f *model.RequestParamAnomalies) ([]model.Anomaly, error) {
+	fb, cond, err := anomalyFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	from, to, gap := fb.arg(*f.StartTime), fb.arg(*f.EndTime), fb.arg(f.DuplicateGap.Seconds())
+
+	query := fmt.Sprintf(`SELECT %[6]s, d.id
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   JOIN LATERAL (
+	   SELECT o2.id FROM operations o2
+	   WHERE o2.id <> o.id AND o2.amount = o.amount AND o2.type = o.type
+	   AND o2.actor_id IS NOT DISTINCT FROM o.actor_id AND o2.category_id IS NOT DISTINCT FROM o.category_id
+	   AND lower(COALESCE(o2.description, '')) = lower(COALESCE(o.description, ''))
+	   AND o2.operation_at >= o.operation_at - make_interval(secs => %[4]s::float8) AND o2.operation_at <= o.operation_at
+	   AND (o2.operation_at < o.operation_at OR o2.id < o.id)
+	   ORDER BY o2.operation_at DESC, o2.id DESC
+	   LIMIT 1) d ON TRUE
+	   WHERE %[1]s AND o.operation_at >= %[2]s AND o.operation_at <= %[3]s
+	   ORDER BY o.operation_at DESC, o.id DESC
+	   LIMIT %[5]d`, cond, from, to, gap, model.MaxAnomalies, operationColumns)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.Anomaly, 0)
+	for rows.Next() {
+		item := model.Anomaly{Reason: model.AnomalyDuplicate}
+		var original int64
+		if err := scanOperation(rows, &item.Operation, &original); err != nil {
+			return nil, err
+		}
+		item.DuplicateOf = &original
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+// categorySpikes сравнивает расходы категорий за последнюю неделю окна с их недельными расходами за базовый период.
+// Недели отсчитываются назад от SpikeFrom, неделя без расходов входит в базу нулем
+func (pr *PostgresRepo) categorySpikes(ctx context.Context, f *model.RequestParamAnomalies) ([]model.CategorySpike, error) {
+	fb, cond, err := anomalyFilter(f)
+	if err != nil {
+		return nil, err
+	}
+	spikeFrom, to, weeks, z := fb.arg(f.SpikeFrom), fb.arg(*f.EndTime), fb.arg(f.SpikeWeeks), fb.arg(*f.ZScore)
+
+	query := fmt.Sprintf(`WITH weekly AS (
+	   SELECT o.category_id, floor(extract(epoch FROM (%[2]s::timestamptz - o.operation_at)) / 604800) AS w,
+	   SUM(ABS(o.amount))::float8 AS s
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   WHERE %[1]s AND o.type = '%[6]s'
+	   AND o.operation_at >= %[2]s::timestamptz - make_interval(weeks => %[4]s::int) AND o.operation_at < %[2]s
+	   GROUP BY 1, 2),
+	   base AS (
+	   SELECT category_id, SUM(s) / %[4]s::int AS avg,
+	   sqrt(GREATEST(SUM(s * s) - SUM(s) * SUM(s) / %[4]s::int, 0) / (%[4]s::int - 1)) AS sd
+	   FROM weekly
+	   GROUP BY category_id),
+	   cur AS (
+	   SELECT o.category_id, COALESCE(c.cat_name, '') AS cat_name, SUM(ABS(o.amount))::float8 AS amount, COUNT(*) AS cnt,
+	   array_to_string(array_agg(o.id ORDER BY o.operation_at, o.id), ',') AS ids
+	   FROM operations o 
+	   LEFT JOIN category c ON c.id = o.category_id 
+	   LEFT JOIN family_members f ON f.id = o.actor_id
+	   WHERE %[1]s AND o.type = '%[6]s' AND o.operation_at >= %[2]s AND o.operation_at <= %[3]s
+	   GROUP BY o.category_id, c.cat_name)
+	   SELECT cur.cat_name, cur.amount, cur.cnt, cur.ids, b.avg, b.sd, (cur.amount - b.avg) / b.sd
+	   FROM cur
+	   JOIN base b ON b.category_id IS NOT DISTINCT FROM cur.category_id
+	   WHERE b.sd > 0 AND (cur.amount - b.avg) / b.sd > %[5]s::float8
+	   ORDER BY 7 DESC
+	   LIMIT %[7]d`, cond, spikeFrom, to, weeks, z, model.OpTypeCredit, model.MaxAnomalies)
+
+	rows, err := pr.conn().QueryContext(ctx, query, fb.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]model.CategorySpike, 0)
+	for rows.Next() {
+		item := model.CategorySpike{From: f.SpikeFrom, To: *f.EndTime, Baseline: model.WeeklyBaseline{Weeks: f.SpikeWeeks}}
+		var ids string
+		if err := rows.Scan(&item.Category, &item.Amount, &item.Count, &ids, &item.Baseline.Avg, &item.Baseline.Stddev, &item.ZScore); err != nil {
+			return nil, err
+		}
+		for _, id := range strings.Split(ids, ",") {
+			n, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			item.OperationIDs = append(item.OperationIDs, n)
+		}
+		result = append(result, item)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	return result, nil
+}
+
+// buildPrefixTSQuery собирает tsquery вида "аптек:* & uber:*"; слова уже очищены сервисом до букв и цифр
+func buildPrefixTSQuery(terms []string) string {
+	parts := make([]string, 0, len(terms))
+	for _, t := range terms {
+		parts = append(parts, t+":*")
+	}
+	return strings.Join(parts, " & ")
+}
+
+// rowScanner - общий метод *sql.Row и *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// operationColumns - колонки операции в порядке scanOperation; запрос должен содержать алиасы o, c и f.
+// Метки читаются строкой через запятую: запятых в них нет, а массивы драйвером не сканируются
+const operationColumns = "o.id, o.amount, f.fam_member, c.cat_name, o.type, o.operation_at, o.created_at, o.description, array_to_string(o.tags, ','), o.account"
+
+// scanOperation читает колонки operationColumns и extra после них.
+// Актор и категория становятся NULL после удаления справочной записи (ON DELETE SET NULL) - в операции это пустая строка
+func scanOperation(row rowScanner, op *model.Operation, extra ...any) error {
+	var actor, category sql.NullString
+	var tags string
+	dest := append([]any{&op.ID, &op.Amount, &actor, &category, &op.Type, &op.OperationAt, &op.CreatedAt, &op.Description, &tags, &op.Account}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+
+	op.Actor, op.Category = actor.String, category.String
+	op.Tags = nil
+	if tags != "" {
+		op.Tags = strings.Split(tags, ",")
+	}
+	return nil
+}
+
+func scanOperationRows(rows *sql.Rows) ([]model.Operation, error) {
+	defer rows.Close()
+
+	result := make([]model.Operation, 0)
+	for rows.Next() {
+		item := model.Operation{}
+		if err := scanOperation(rows, &item); err != nil {
+			return nil, err
+		}
+		result = append(result, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func defineGroupExpr(input string, tb model.TimeBuckets) (string, error) {
+	if unit, ok := timeBucketUnits[input]; ok {
+		return defineBucketExpr(unit, "o.operation_at", tb), nil
+	}
+
+	switch input {
+	case model.GroupByActor:
+		return "f.fam_member", nil
+	case model.GroupByCategory:
+		return "c.cat_name", nil
+	case model.GroupByOpType:
+		return "o.type", nil
 	default:
-		return "", model.ErrInvalidOrderBy
+		return "", model.ErrInvalidGroupBy
+	}
+}
+
+// defineBucketExpr - начало интервала unit для момента ts по местному времени зоны запроса (timestamp без зоны).
+// Неделя с воскресенья: сдвигаем на день вперед, берем понедельник и возвращаемся на день назад
+func defineBucketExpr(unit, ts string, tb model.TimeBuckets) string {
+	local := ts + " AT TIME ZONE " + quoteLiteral(timeZoneName(tb))
+	if unit == "week" && tb.WeekStart != nil && *tb.WeekStart == model.WeekStartSunday {
+		return "(date_trunc('week', " + local + " + interval '1 day') - interval '1 day')"
+	}
+	return "date_trunc('" + unit + "', " + local + ")"
+}
+
+func timeZoneName(tb model.TimeBuckets) string {
+	if tb.Location == nil {
+		return "UTC"
+	}
+	return tb.Location.String()
+}
+
+// quoteLiteral - строковый литерал SQL; имя зоны проверено сервисом, экранирование - страховка
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// defineStatsExpr - колонки sum, avg, count, median, p90 по выражению value; cond сужает выборку через FILTER.
+// На пустой выборке агрегаты вернут NULL - для метрик это нули. COUNT(o.id), а не COUNT(*): у пустого интервала fill
+// после LEFT JOIN есть строка без операции
+func defineStatsExpr(value, cond string) string {
+	filter := defineFilterClause(cond)
+
+	return fmt.Sprintf(`COALESCE(SUM(%[1]s)%[2]s, 0)::float8,
+	   COALESCE(AVG(%[1]s)%[2]s, 0)::float8,
+	   COUNT(o.id)%[2]s,
+	   COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY %[1]s)%[2]s, 0)::float8,
+	   COALESCE(percentile_cont(0.9) WITHIN GROUP (ORDER BY %[1]s)%[2]s, 0)::float8`, value, filter)
+}
+
+func defineFilterClause(cond string) string {
+	if cond == "" {
+		return ""
+	}
+	return " FILTER (WHERE " + cond + ")"
+}
+
+// analyticsSections - net (суммы со знаком), income (debit) и expense (credit по модулю: расходы хранятся отрицательными):
+// выражение суммы и условие FILTER, на которых считаются метрики раздела
+var analyticsSections = []struct{ value, cond string }{
+	{"o.amount", ""},
+	{"o.amount", "o.type = '" + model.OpTypeDebit + "'"},
+	{"ABS(o.amount)", "o.type = '" + model.OpTypeCredit + "'"},
+}
+
+// analyticsSectionsExpr - метрики всех разделов за один проход по выборке
+var analyticsSectionsExpr = func() string {
+	exprs := make([]string, 0, len(analyticsSections))
+	for _, s := range analyticsSections {
+		exprs = append(exprs, defineStatsExpr(s.value, s.cond))
+	}
+	return strings.Join(exprs, ",\n\t   ")
+}()
+
+func analyticsSectionsDest(net, income, expense *model.AnalyticsStats) []any {
+	dest := make([]any, 0, 15)
+	for _, st := range []*model.AnalyticsStats{net, income, expense} {
+		dest = append(dest, &st.Sum, &st.Avg, &st.Count, &st.Median, &st.P90)
+	}
+	return dest
+}
+
+// defineExtraStatsExpr - дополнительные колонки для каждого раздела на его же основе (у expense - суммы по модулю):
+// сначала все ключи net, затем income и expense. pNN - перцентиль, остальное - из ExtraStatsMap.
+// Значения перцентилей уже проверены сервисом и попадают в запрос числом, а не строкой клиента
+func defineExtraStatsExpr(keys []string) (string, error) {
+	var sb strings.Builder
+	for _, s := range analyticsSections {
+		filter := defineFilterClause(s.cond)
+		for _, key := range keys {
+			var expr string
+			switch key {
+			case model.StatMin:
+				expr = "MIN(" + s.value + ")"
+			case model.StatMax:
+				expr = "MAX(" + s.value + ")"
+			case model.StatStddev:
+				expr = "stddev_samp(" + s.value + ")"
+			case model.StatVariance:
+				expr = "var_samp(" + s.value + ")"
+			case model.StatMode:
+				expr = "mode() WITHIN GROUP (ORDER BY " + s.value + ")"
+			default:
+				p, err := strconv.ParseFloat(strings.TrimPrefix(key, "p"), 64)
+				if err != nil || !strings.HasPrefix(key, "p") || !(p > 0 && p < 100) {
+					return "", model.ErrInvalidPercentiles
+				}
+				expr = "percentile_cont(" + strconv.FormatFloat(p/100, 'f', -1, 64) + ") WITHIN GROUP (ORDER BY " + s.value + ")"
+			}
+			// stddev/variance по одной операции и любые агрегаты по пустой выборке - NULL
+			sb.WriteString(",\n\t   COALESCE(" + expr + filter + ", 0)::float8")
+		}
+	}
+	return sb.String(), nil
+}
+
+// assignExtraStats раскладывает колонки defineExtraStatsExpr по разделам
+func assignExtraStats(keys []string, values []float64, net, income, expense *model.AnalyticsStats) {
+	if len(keys) == 0 {
+		return
+	}
+	for i, st := range []*model.AnalyticsStats{net, income, expense} {
+		st.Stats = make(map[string]float64, len(keys))
+		for j, key := range keys {
+			st.Stats[key] = values[i*len(keys)+j]
+		}
+	}
+}
+
+// timeBucketUnits - единицы date_trunc/generate_series для временных измерений
+var timeBucketUnits = map[string]string{
+	model.GroupByDay:   "day",
+	model.GroupByWeek:  "week",
+	model.GroupByMonth: "month",
+	model.GroupByYear:  "year",
+}
+
+// defineGroupKeyExpr - выражение ключа группы в ответе: начало временного интервала отдается ISO-датой в зоне запроса
+func defineGroupKeyExpr(dim, expr string) string {
+	if _, ok := timeBucketUnits[dim]; ok {
+		return "to_char(" + expr + ", 'YYYY-MM-DD')"
 	}
+	return expr
 }
 
-func definePeriodExpr(start, end *time.Time) string {
-	switch {
-	case start != nil && end != nil:
-		return fmt.Sprintf("WHERE operation_at BETWEEN '%s' AND '%s'", start.Format(time.RFC3339), end.Format(time.RFC3339))
-	case start != nil:
-		return fmt.Sprintf("WHERE operation_at > '%s'", start.Format(time.RFC3339))
-	case end != nil:
-		return fmt.Sprintf("WHERE operation_at < '%s'", end.Format(time.RFC3339))
+func defineMetricExpr(metric string) (string, error) {
+	switch metric {
+	case model.MetricSum:
+		return "SUM(amount)::float8", nil
+	case model.MetricCount:
+		return "COUNT(*)::float8", nil
+	case model.MetricAvg:
+		return "AVG(amount)::float8", nil
+	case model.MetricMedian:
+		return "percentile_cont(0.5) WITHIN GROUP (ORDER BY amount)::float8", nil
+	case model.MetricP90:
+		return "percentile_cont(0.9) WITHIN GROUP (ORDER BY amount)::float8", nil
 	default:
+		return "", model.ErrInvalidMetric
+	}
+}
+
+func defineLimitOffsetExpr(lim, p *int) string {
+	if lim == nil && p == nil { // оба значения нил - вообще не применяем их к квери
 		return ""
 	}
+
+	// избавляемся от указателей
+	var limit, page int
+	if lim != nil {
+		limit = *lim
+	}
+	if p != nil {
+		page = *p
+	}
+
+	if limit <= 0 { // задаем значение по умолчанию если лимит пуст/некорректен
+		limit = 20
+	}
+
+	if limit > 1000 { // защита от слишком больших значений
+		limit = 1000
+	}
+
+	if page <= 0 { // если страница имеет некорректное значение - ставим 1
+		page = 1
+	}
+
+	// оба значения корректны - добавляем в квери
+	offset := limit * (page - 1)
+	return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
 }
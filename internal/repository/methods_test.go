@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+func TestDefineExtraStatsExprSections(t *testing.T) {
+	expr, err := defineExtraStatsExpr([]string{model.StatMax, "p95", model.StatMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := strings.Split(strings.TrimPrefix(expr, ",\n\t   "), ",\n\t   ")
+
+	// сначала все ключи net, затем income и expense - в этом порядке их читает assignExtraStats
+	want := []string{
+		"COALESCE(MAX(o.amount), 0)::float8",
+		"COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY o.amount), 0)::float8",
+		"COALESCE(mode() WITHIN GROUP (ORDER BY o.amount), 0)::float8",
+		"COALESCE(MAX(o.amount) FILTER (WHERE o.type = 'debit'), 0)::float8",
+		"COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY o.amount) FILTER (WHERE o.type = 'debit'), 0)::float8",
+		"COALESCE(mode() WITHIN GROUP (ORDER BY o.amount) FILTER (WHERE o.type = 'debit'), 0)::float8",
+		"COALESCE(MAX(ABS(o.amount)) FILTER (WHERE o.type = 'credit'), 0)::float8",
+		"COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY ABS(o.amount)) FILTER (WHERE o.type = 'credit'), 0)::float8",
+		"COALESCE(mode() WITHIN GROUP (ORDER BY ABS(o.amount)) FILTER (WHERE o.type = 'credit'), 0)::float8",
+	}
+	if len(columns) != len(want) {
+		t.Fatalf("columns = %d, want %d:\n%s", len(columns), len(want), expr)
+	}
+	for i := range want {
+		if columns[i] != want[i] {
+			t.Errorf("[%d]\n got: %s\nwant: %s", i, columns[i], want[i])
+		}
+	}
+}
+
+func TestDefineExtraStatsExprInvalidPercentile(t *testing.T) {
+	for _, key := range []string{"p0", "p100", "pabc", "median"} {
+		if _, err := defineExtraStatsExpr([]string{key}); err != model.ErrInvalidPercentiles {
+			t.Errorf("defineExtraStatsExpr(%q) error = %v, want ErrInvalidPercentiles", key, err)
+		}
+	}
+}
+
+func TestAssignExtraStatsCreditOnly(t *testing.T) {
+	// выборка только из расходов -100, -2500 и -900 руб.: по суммам со знаком max - самый маленький расход,
+	// а раздел expense считается по модулю, и его max - самый крупный
+	keys := []string{model.StatMin, model.StatMax}
+	values := []float64{
+		-250000, -10000, // net
+		0, 0, // income - доходов в выборке нет
+		10000, 250000, // expense
+	}
+	var net, income, expense model.AnalyticsStats
+	assignExtraStats(keys, values, &net, &income, &expense)
+
+	if net.Stats[model.StatMax] != -10000 || net.Stats[model.StatMin] != -250000 {
+		t.Errorf("net stats = %v", net.Stats)
+	}
+	if expense.Stats[model.StatMax] != 250000 || expense.Stats[model.StatMin] != 10000 {
+		t.Errorf("expense stats = %v, want max 250000 and min 10000", expense.Stats)
+	}
+	if len(income.Stats) != 2 || income.Stats[model.StatMax] != 0 {
+		t.Errorf("income stats = %v, want zeros for every key", income.Stats)
+	}
+
+	var empty model.AnalyticsStats
+	assignExtraStats(nil, nil, &empty, &empty, &empty)
+	if empty.Stats != nil {
+		t.Errorf("stats without keys = %v, want nil", empty.Stats)
+	}
+}
+
+func TestGetOperationQueryLock(t *testing.T) {
+	if q := getOperationQuery(false); strings.Contains(q, "FOR UPDATE") {
+		t.Errorf("plain get locks the row:\n%s", q)
+	}
+	// FOR UPDATE без OF o Postgres отклонит из-за LEFT JOIN справочников
+	if q := getOperationQuery(true); !strings.HasSuffix(q, "WHERE o.id = $1 FOR UPDATE OF o") {
+		t.Errorf("get for update does not lock the operation row:\n%s", q)
+	}
+}
@@ -18,11 +18,26 @@ import (
 type OperationsRepository interface {
 	Create(ctx context.Context, op *model.Operation) error
 	Get(ctx context.Context, id int) (*model.Operation, error)
+	GetForUpdate(ctx context.Context, id int) (*model.Operation, error)
 	List(ctx context.Context, f *model.RequestParamOperations) ([]model.Operation, error)
+	ListPage(ctx context.Context, f *model.RequestParamOperations) (*model.OperationsPage, error)
+	ListEnvelope(ctx context.Context, f *model.RequestParamOperations) (*model.OperationsEnvelope, error)
+	Search(ctx context.Context, f *model.RequestParamSearch) ([]model.SearchHit, error)
 	Update(ctx context.Context, op *model.Operation) error
 	Delete(ctx context.Context, id int) error
 	AnalyticsGroup(ctx context.Context, f *model.RequestParamAnalytics) ([]model.AnalyticsQuantum, error)
 	AnalyticsSummary(ctx context.Context, f *model.RequestParamAnalytics) (*model.AnalyticsSummary, error)
+	AnalyticsPivot(ctx context.Context, f *model.RequestParamPivot) ([]model.PivotCell, error)
+	AnalyticsCashflow(ctx context.Context, f *model.RequestParamCashflow) ([]model.CashflowBucket, error)
+	AnalyticsMonthlyByCategory(ctx context.Context, f *model.RequestParamForecast) ([]model.MonthlyAggregate, error)
+	AnalyticsTop(ctx context.Context, f *model.RequestParamTop) ([]model.TopGroup, error)
+	AnalyticsHistogram(ctx context.Context, f *model.RequestParamHistogram) ([]model.HistogramCell, error)
+	Anomalies(ctx context.Context, f *model.RequestParamAnomalies) (*model.Anomalies, error)
+	BulkUpdatePreview(ctx context.Context, f *model.OperationFilter, limit int) (int64, []model.Operation, error)
+	BulkUpdate(ctx context.Context, f *model.OperationFilter, set *model.BulkUpdateSet) (int64, error)
+	GetIdempotencyKey(ctx context.Context, key string, ttl time.Duration) (*model.IdempotencyRecord, error)
+	SaveIdempotencyKey(ctx context.Context, rec *model.IdempotencyRecord, ttl time.Duration) error
+	InTx(ctx context.Context, fn func(repo OperationsRepository) error) error
 }
 
 func NewOperationsRepo(dbconn *dbpg.DB) OperationsRepository {
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// validateAnomalies проставляет пороги по умолчанию и считает границы базовых периодов от окна from/to
+func validateAnomalies(rpa *model.RequestParamAnomalies, now time.Time) error {
+	if rpa.EndTime == nil {
+		rpa.EndTime = &now
+	}
+	if rpa.StartTime == nil {
+		from := rpa.EndTime.AddDate(0, 0, -model.DefaultAnomalyDays)
+		rpa.StartTime = &from
+	}
+	if !rpa.StartTime.Before(*rpa.EndTime) {
+		return model.ErrInvalidAnomalyParams
+	}
+
+	if rpa.Percentile == nil {
+		p := float64(model.DefaultAnomalyPercentile)
+		rpa.Percentile = &p
+	}
+	if !(*rpa.Percentile > 0 && *rpa.Percentile < 100) {
+		return model.ErrInvalidAnomalyParams
+	}
+	if rpa.ZScore == nil {
+		z := float64(model.DefaultAnomalyZScore)
+		rpa.ZScore = &z
+	}
+	if !(*rpa.ZScore > 0) {
+		return model.ErrInvalidAnomalyParams
+	}
+	if rpa.BaselineDays == nil {
+		days := model.DefaultBaselineDays
+		rpa.BaselineDays = &days
+	}
+	if *rpa.BaselineDays < model.MinBaselineDays || *rpa.BaselineDays > model.MaxBaselineDays {
+		return model.ErrInvalidAnomalyParams
+	}
+	rpa.DuplicateGap = model.DefaultDuplicateWindow
+	if rpa.DuplicateWindow != nil {
+		gap, err := time.ParseDuration(*rpa.DuplicateWindow)
+		if err != nil || gap <= 0 || gap > model.MaxDuplicateWindow {
+			return model.ErrInvalidAnomalyParams
+		}
+		rpa.DuplicateGap = gap
+	}
+	if err := validateOperationFilter(&rpa.OperationFilter); err != nil {
+		return err
+	}
+
+	// выбросы сравниваются с периодом перед окном, всплески - последняя неделя окна с целыми неделями перед ней.
+	// Окно короче недели проверяется целиком - операции до from в отчет не попадают
+	rpa.BaselineFrom = rpa.StartTime.AddDate(0, 0, -*rpa.BaselineDays)
+	rpa.SpikeFrom = rpa.EndTime.AddDate(0, 0, -7)
+	if rpa.SpikeFrom.Before(*rpa.StartTime) {
+		rpa.SpikeFrom = *rpa.StartTime
+	}
+	rpa.SpikeWeeks = *rpa.BaselineDays / 7
+	return nil
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// compareWindow - окно для сравнения и начала обоих окон - для сопоставления ключей временных измерений
+type compareWindow struct {
+	from, to  time.Time
+	current   time.Time // начало текущего окна
+	weekStart string
+}
+
+// defineCompareWindow строит окно сравнения. previous_year - те же даты годом раньше.
+// previous_period - если окно состоит из целых месяцев (from - начало месяца, to - конец месяца или начало следующего),
+// то столько же месяцев до from, иначе отрезок той же длительности вплотную перед from
+func defineCompareWindow(mode string, from, to time.Time, loc *time.Location, weekStart string) compareWindow {
+	from, to = from.In(loc), to.In(loc)
+
+	if mode == model.ComparePreviousYear {
+		return compareWindow{from: from.AddDate(-1, 0, 0), to: to.AddDate(-1, 0, 0), current: from, weekStart: weekStart}
+	}
+
+	if months := wholeMonths(from, to); months > 0 {
+		boundary := from.AddDate(0, months, 0)
+		prevTo := from.Add(to.Sub(boundary))
+		if !prevTo.Before(from) { // to включительно - граница from уже принадлежит текущему окну
+			prevTo = from.Add(-time.Microsecond)
+		}
+		return compareWindow{from: from.AddDate(0, -months, 0), to: prevTo, current: from, weekStart: weekStart}
+	}
+
+	// to=...T23:59:59 - включительная форма: окно на секунду короче целых суток, но сдвигать надо на целые сутки
+	duration := to.Sub(from)
+	if (duration+time.Second)%(24*time.Hour) == 0 {
+		duration += time.Second
+	}
+	return compareWindow{from: from.Add(-duration), to: from.Add(-time.Microsecond), current: from, weekStart: weekStart}
+}
+
+// wholeMonths - сколько целых месяцев покрывает окно; 0, если границы не совпадают с началом месяца
+func wholeMonths(from, to time.Time) int {
+	if from.Day() != 1 || from.Hour() != 0 || from.Minute() != 0 || from.Second() != 0 || from.Nanosecond() != 0 {
+		return 0
+	}
+
+	// to - начало следующего месяца или последняя секунда перед ним
+	next := to.Add(time.Second)
+	boundary := time.Date(next.Year(), next.Month(), 1, 0, 0, 0, 0, to.Location())
+	if to.Before(boundary.Add(-time.Second)) || to.After(boundary) {
+		return 0
+	}
+
+	return (boundary.Year()-from.Year())*12 + int(boundary.Month()) - int(from.Month())
+}
+
+// shiftKey переносит ключ временного измерения из окна сравнения в текущее: номер интервала от начала окна сравнения
+// откладывается от начала текущего окна, поэтому недели остаются неделями, а месяц - месяцем при любой длине окна
+func (w compareWindow) shiftKey(dim, key string) string {
+	switch dim {
+	case model.GroupByDay, model.GroupByWeek, model.GroupByMonth, model.GroupByYear:
+	default:
+		return key
+	}
+	t, err := time.Parse("2006-01-02", key)
+	if err != nil {
+		return key
+	}
+
+	prevStart, curStart := bucketStart(dim, w.from, w.weekStart), bucketStart(dim, w.current, w.weekStart)
+	switch dim {
+	case model.GroupByMonth:
+		months := (t.Year()-prevStart.Year())*12 + int(t.Month()) - int(prevStart.Month())
+		return curStart.AddDate(0, months, 0).Format("2006-01-02")
+	case model.GroupByYear:
+		return curStart.AddDate(t.Year()-prevStart.Year(), 0, 0).Format("2006-01-02")
+	default: // day и week - ключи в сутках, даты в UTC без переходов на летнее время
+		days := int(t.Sub(prevStart).Hours() / 24)
+		return curStart.AddDate(0, 0, days).Format("2006-01-02")
+	}
+}
+
+// bucketStart - начало интервала dim, в который попадает t по местному времени; дата в UTC, как ключи из БД
+func bucketStart(dim string, t time.Time, weekStart string) time.Time {
+	d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch dim {
+	case model.GroupByWeek:
+		offset := (int(d.Weekday()) + 6) % 7 // дней от понедельника
+		if weekStart == model.WeekStartSunday {
+			offset = int(d.Weekday())
+		}
+		return d.AddDate(0, 0, -offset)
+	case model.GroupByMonth:
+		return time.Date(d.Year(), d.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case model.GroupByYear:
+		return time.Date(d.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return d
+	}
+}
+
+func buildComparison(mode string, w compareWindow, dims []string, cur, prev *model.AnalyticsSummary) *model.AnalyticsComparison {
+	result := &model.AnalyticsComparison{
+		Mode:   mode,
+		From:   w.from,
+		To:     w.to,
+		Totals: defineDeltas(cur.Sum, cur.Income.Sum, cur.Expense.Sum, cur.Count, prev.Sum, prev.Income.Sum, prev.Expense.Sum, prev.Count),
+	}
+	if len(dims) == 0 {
+		return result
+	}
+
+	// группы предыдущего окна по ключу, приведенному к текущему окну
+	prevByKey := make(map[string]model.AnalyticsQuantum, len(prev.Groups))
+	prevOrder := make([]string, 0, len(prev.Groups))
+	for _, g := range prev.Groups {
+		keys := make(map[string]string, len(dims))
+		for _, dim := range dims {
+			keys[dim] = w.shiftKey(dim, g.Keys[dim])
+		}
+		g.Keys = keys
+		g.Key = joinGroupKeys(dims, keys)
+		prevByKey[g.Key] = g
+		prevOrder = append(prevOrder, g.Key)
+	}
+
+	result.Groups = make([]model.AnalyticsGroupDelta, 0, len(cur.Groups))
+	seen := make(map[string]struct{}, len(cur.Groups))
+	for _, g := range cur.Groups {
+		item := model.AnalyticsGroupDelta{Key: g.Key, Keys: g.Keys, Status: model.DeltaNew}
+		p, ok := prevByKey[g.Key]
+		if ok {
+			item.Status = model.DeltaMatched
+			seen[g.Key] = struct{}{}
+		}
+		item.AnalyticsDeltas = defineDeltas(g.Sum, g.Income.Sum, g.Expense.Sum, g.Count, p.Sum, p.Income.Sum, p.Expense.Sum, p.Count)
+		result.Groups = append(result.Groups, item)
+	}
+	for _, key := range prevOrder {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		p := prevByKey[key]
+		item := model.AnalyticsGroupDelta{Key: p.Key, Keys: p.Keys, Status: model.DeltaDisappeared}
+		item.AnalyticsDeltas = defineDeltas(0, 0, 0, 0, p.Sum, p.Income.Sum, p.Expense.Sum, p.Count)
+		result.Groups = append(result.Groups, item)
+	}
+
+	return result
+}
+
+func joinGroupKeys(dims []string, keys map[string]string) string {
+	values := make([]string, 0, len(dims))
+	for _, dim := range dims {
+		values = append(values, keys[dim])
+	}
+	return strings.Join(values, model.GroupKeySeparator)
+}
+
+func defineDeltas(sum, income, expense float64, count int, prevSum, prevIncome, prevExpense float64, prevCount int) model.AnalyticsDeltas {
+	return model.AnalyticsDeltas{
+		Sum:     defineDelta(sum, prevSum),
+		Income:  defineDelta(income, prevIncome),
+		Expense: defineDelta(expense, prevExpense),
+		Count:   defineDelta(float64(count), float64(prevCount)),
+	}
+}
+
+func defineDelta(current, previous float64) model.AnalyticsDelta {
+	d := model.AnalyticsDelta{Current: current, Previous: previous, Delta: current - previous}
+	if previous != 0 {
+		// от модуля: для отрицательных сумм рост расхода тоже дает отрицательный процент
+		pct := d.Delta / math.Abs(previous) * 100
+		d.DeltaPct = &pct
+	}
+	return d
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+func mustTime(t *testing.T, s string, loc *time.Location) time.Time {
+	t.Helper()
+	v, err := time.ParseInLocation("2006-01-02T15:04:05", s, loc)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return v
+}
+
+func TestDefineCompareWindow(t *testing.T) {
+	msk, err := time.LoadLocation("Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		from, to string
+		wantFrom string
+		wantTo   string
+	}{
+		{"previous year", model.ComparePreviousYear, "2026-10-01T00:00:00", "2026-10-31T23:59:59", "2025-10-01T00:00:00", "2025-10-31T23:59:59"},
+		{"whole month inclusive", model.ComparePreviousPeriod, "2026-10-01T00:00:00", "2026-10-31T23:59:59", "2026-09-01T00:00:00", "2026-09-30T23:59:59"},
+		{"whole months exclusive", model.ComparePreviousPeriod, "2026-01-01T00:00:00", "2026-04-01T00:00:00", "2025-10-01T00:00:00", "2025-12-31T23:59:59.999999"},
+		{"whole days exclusive", model.ComparePreviousPeriod, "2026-10-08T00:00:00", "2026-10-15T00:00:00", "2026-10-01T00:00:00", "2026-10-07T23:59:59.999999"},
+		{"whole days inclusive", model.ComparePreviousPeriod, "2026-10-08T00:00:00", "2026-10-14T23:59:59", "2026-10-01T00:00:00", "2026-10-07T23:59:59.999999"},
+		{"hours", model.ComparePreviousPeriod, "2026-10-08T10:00:00", "2026-10-08T16:00:00", "2026-10-08T04:00:00", "2026-10-08T09:59:59.999999"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := defineCompareWindow(tt.mode, mustTime(t, tt.from, msk), mustTime(t, tt.to, msk), msk, model.WeekStartMonday)
+			layout := "2006-01-02T15:04:05.999999"
+			if got := w.from.Format(layout); got != tt.wantFrom {
+				t.Errorf("from = %s, want %s", got, tt.wantFrom)
+			}
+			if got := w.to.Format(layout); got != tt.wantTo {
+				t.Errorf("to = %s, want %s", got, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestCompareShiftKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		from, to  string
+		weekStart string
+		dim       string
+		key       string
+		want      string
+	}{
+		{"day previous period exclusive", model.ComparePreviousPeriod, "2026-10-08T00:00:00", "2026-10-15T00:00:00", model.WeekStartMonday, model.GroupByDay, "2026-10-01", "2026-10-08"},
+		{"day previous period inclusive", model.ComparePreviousPeriod, "2026-10-08T00:00:00", "2026-10-14T23:59:59", model.WeekStartMonday, model.GroupByDay, "2026-10-03", "2026-10-10"},
+		{"day previous year", model.ComparePreviousYear, "2026-10-01T00:00:00", "2026-10-07T23:59:59", model.WeekStartMonday, model.GroupByDay, "2025-10-03", "2026-10-03"},
+		{"week previous year", model.ComparePreviousYear, "2026-10-05T00:00:00", "2026-10-31T23:59:59", model.WeekStartMonday, model.GroupByWeek, "2025-10-06", "2026-10-12"},
+		{"week previous year partial first week", model.ComparePreviousYear, "2026-10-05T00:00:00", "2026-10-31T23:59:59", model.WeekStartMonday, model.GroupByWeek, "2025-09-29", "2026-10-05"},
+		{"week previous year sunday start", model.ComparePreviousYear, "2026-10-04T00:00:00", "2026-10-31T23:59:59", model.WeekStartSunday, model.GroupByWeek, "2025-10-05", "2026-10-11"},
+		{"week previous period", model.ComparePreviousPeriod, "2026-10-05T00:00:00", "2026-10-18T23:59:59", model.WeekStartMonday, model.GroupByWeek, "2026-09-28", "2026-10-12"},
+		{"week previous period whole months", model.ComparePreviousPeriod, "2026-10-01T00:00:00", "2026-10-31T23:59:59", model.WeekStartMonday, model.GroupByWeek, "2026-09-07", "2026-10-05"},
+		{"month previous period days", model.ComparePreviousPeriod, "2026-10-08T00:00:00", "2026-10-14T23:59:59", model.WeekStartMonday, model.GroupByMonth, "2026-10-01", "2026-10-01"},
+		{"month previous period months", model.ComparePreviousPeriod, "2026-10-01T00:00:00", "2026-12-31T23:59:59", model.WeekStartMonday, model.GroupByMonth, "2026-08-01", "2026-11-01"},
+		{"month previous year", model.ComparePreviousYear, "2026-10-01T00:00:00", "2026-12-31T23:59:59", model.WeekStartMonday, model.GroupByMonth, "2025-11-01", "2026-11-01"},
+		{"year previous period months", model.ComparePreviousPeriod, "2026-01-01T00:00:00", "2026-03-31T23:59:59", model.WeekStartMonday, model.GroupByYear, "2025-01-01", "2026-01-01"},
+		{"year previous year", model.ComparePreviousYear, "2026-01-01T00:00:00", "2026-12-31T23:59:59", model.WeekStartMonday, model.GroupByYear, "2025-01-01", "2026-01-01"},
+		{"not a time dimension", model.ComparePreviousYear, "2026-01-01T00:00:00", "2026-12-31T23:59:59", model.WeekStartMonday, model.GroupByCategory, "food", "food"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := defineCompareWindow(tt.mode, mustTime(t, tt.from, time.UTC), mustTime(t, tt.to, time.UTC), time.UTC, tt.weekStart)
+			if got := w.shiftKey(tt.dim, tt.key); got != tt.want {
+				t.Errorf("shiftKey(%s, %s) = %s, want %s", tt.dim, tt.key, got, tt.want)
+			}
+		})
+	}
+}
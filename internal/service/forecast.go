@@ -0,0 +1,144 @@
+package service
+
+import (
+	"math"
+	"slices"
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/forecast"
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// validateForecast проставляет значения по умолчанию; окно истории считает сервис, поэтому from/to из запроса не принимаются
+func validateForecast(rpf *model.RequestParamForecast) error {
+	if rpf.StartTime != nil || rpf.EndTime != nil {
+		return model.ErrInvalidForecast
+	}
+	if rpf.Months == nil {
+		months := model.DefaultForecastMonths
+		rpf.Months = &months
+	}
+	if rpf.History == nil {
+		history := model.DefaultForecastHistory
+		rpf.History = &history
+	}
+	if *rpf.Months < 1 || *rpf.Months > model.MaxForecastMonths {
+		return model.ErrInvalidForecast
+	}
+	if *rpf.History < model.MinForecastHistory || *rpf.History > model.MaxForecastHistory {
+		return model.ErrInvalidForecast
+	}
+	return validateOperationFilter(&rpf.OperationFilter)
+}
+
+// categorySeries - помесячная история категории и факт текущего месяца
+type categorySeries struct {
+	income, expense []float64
+	actual          model.ForecastActual
+}
+
+// buildForecast раскладывает агрегаты по категориям в плотные ряды (месяц без операций - 0) и прогнозирует доходы и
+// расходы каждой категории отдельно. Итоги - сумма прогнозов категорий, коридор итогов - из суммы дисперсий
+func buildForecast(aggs []model.MonthlyAggregate, historyFrom time.Time, history, months int) *model.Forecast {
+	series := make(map[string]*categorySeries)
+	for _, a := range aggs {
+		t, err := time.Parse("2006-01-02", a.Month)
+		if err != nil {
+			continue
+		}
+		idx := (t.Year()-historyFrom.Year())*12 + int(t.Month()) - int(historyFrom.Month())
+		if idx < 0 || idx > history {
+			continue
+		}
+		s, ok := series[a.Category]
+		if !ok {
+			s = &categorySeries{income: make([]float64, history), expense: make([]float64, history)}
+			series[a.Category] = s
+		}
+		if idx == history { // текущий месяц еще не закончился - в историю не идет
+			s.actual.Income, s.actual.Expense = a.Income, a.Expense
+			s.actual.Net = a.Income - a.Expense
+			continue
+		}
+		s.income[idx], s.expense[idx] = a.Income, a.Expense
+	}
+
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	result := &model.Forecast{
+		Months:      months,
+		History:     history,
+		HistoryFrom: historyFrom.Format("2006-01-02"),
+		Confidence:  forecast.Confidence,
+		Categories:  make([]model.ForecastCategory, 0, len(names)),
+	}
+
+	// накопители итогов: суммы прогнозов и дисперсий по месяцам
+	totalIncome, totalExpense := make([]forecast.Prediction, months), make([]forecast.Prediction, months)
+	var totalActual model.ForecastActual
+	for _, name := range names {
+		s := series[name]
+		income := forecast.Monthly(historyFrom, s.income, months)
+		expense := forecast.Monthly(historyFrom, s.expense, months)
+
+		category := model.ForecastCategory{Category: name, Months: make([]model.ForecastMonth, 0, months)}
+		for i := range months {
+			item := forecastMonth(income[i], expense[i])
+			if i == 0 {
+				actual := s.actual
+				item.Actual = &actual
+			}
+			category.Months = append(category.Months, item)
+
+			totalIncome[i] = addPredictions(totalIncome[i], income[i])
+			totalExpense[i] = addPredictions(totalExpense[i], expense[i])
+		}
+		result.Categories = append(result.Categories, category)
+
+		totalActual.Income += s.actual.Income
+		totalActual.Expense += s.actual.Expense
+		totalActual.Net += s.actual.Net
+	}
+
+	result.Totals = make([]model.ForecastMonth, 0, months)
+	for i := range months {
+		totalIncome[i].Month = historyFrom.AddDate(0, history+i, 0)
+		totalExpense[i].Month = totalIncome[i].Month
+		item := forecastMonth(withBand(totalIncome[i]), withBand(totalExpense[i]))
+		if i == 0 {
+			item.Actual = &totalActual
+		}
+		result.Totals = append(result.Totals, item)
+	}
+
+	return result
+}
+
+// forecastMonth собирает месяц прогноза; сальдо - разность, его коридор - из суммы дисперсий и может уходить в минус
+func forecastMonth(income, expense forecast.Prediction) model.ForecastMonth {
+	net := income.Value - expense.Value
+	lower, upper := forecast.Band(net, math.Hypot(income.Sigma, expense.Sigma))
+	return model.ForecastMonth{
+		Month:   income.Month.Format("2006-01-02"),
+		Income:  model.ForecastValue{Forecast: income.Value, Lower: income.Lower, Upper: income.Upper},
+		Expense: model.ForecastValue{Forecast: expense.Value, Lower: expense.Lower, Upper: expense.Upper},
+		Net:     model.ForecastValue{Forecast: net, Lower: lower, Upper: upper},
+	}
+}
+
+// addPredictions складывает прогнозы независимых рядов: значения - напрямую, отклонения - через дисперсии
+func addPredictions(total, p forecast.Prediction) forecast.Prediction {
+	total.Value += p.Value
+	total.Sigma = math.Hypot(total.Sigma, p.Sigma)
+	return total
+}
+
+func withBand(p forecast.Prediction) forecast.Prediction {
+	p.Lower, p.Upper = forecast.Band(p.Value, p.Sigma)
+	p.Lower = math.Max(p.Lower, 0)
+	return p
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"strconv"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// validateHistogram разбирает buckets/edges: без обоих - 20 интервалов равной ширины, вместе не принимаются
+func validateHistogram(rph *model.RequestParamHistogram) error {
+	if rph.Buckets != nil && rph.Edges != nil {
+		return model.ErrInvalidHistogram
+	}
+	if rph.Edges != nil {
+		values := splitListValues([]string{*rph.Edges})
+		if len(values) < 2 || len(values) > model.MaxHistogramBuckets+1 {
+			return model.ErrInvalidHistogram
+		}
+		edges := make([]int64, 0, len(values))
+		for i, v := range values {
+			e, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || e < 0 || (i > 0 && e <= edges[i-1]) {
+				return model.ErrInvalidHistogram
+			}
+			edges = append(edges, e)
+		}
+		rph.EdgeValues = edges
+		buckets := len(edges) - 1
+		rph.Buckets = &buckets
+	}
+	if rph.Buckets == nil {
+		buckets := model.DefaultHistogramBuckets
+		rph.Buckets = &buckets
+	}
+	if *rph.Buckets < 1 || *rph.Buckets > model.MaxHistogramBuckets {
+		return model.ErrInvalidHistogram
+	}
+	if rph.Type == nil {
+		opType := model.OpTypeCredit
+		rph.Type = &opType
+	}
+	return validateOperationFilter(&rph.OperationFilter)
+}
+
+// buildHistogram разворачивает строки width_bucket в полный ряд интервалов - пустые интервалы тоже выводятся.
+// Интервалы edges ниже первой и выше последней границы выводятся, только если в них есть операции
+func buildHistogram(rph *model.RequestParamHistogram, cells []model.HistogramCell) *model.Histogram {
+	result := &model.Histogram{Type: *rph.Type, Buckets: make([]model.HistogramBucket, 0)}
+	if len(cells) == 0 {
+		return result
+	}
+
+	// номера width_bucket: 1..n, при edges еще 0 и n+1 для значений за границами
+	n := *rph.Buckets
+	newSeries := func() []model.HistogramBucket {
+		buckets := make([]model.HistogramBucket, n+2)
+		for i := range buckets {
+			buckets[i].Lower, buckets[i].Upper = histogramBounds(rph, cells[0], i)
+		}
+		return buckets
+	}
+
+	total := newSeries()
+	perCategory := make(map[string][]model.HistogramBucket)
+	order := make([]string, 0)
+	for _, c := range cells {
+		if c.Bucket < 0 || c.Bucket > n+1 {
+			continue
+		}
+		total[c.Bucket].Count += c.Count
+		total[c.Bucket].Amount += c.Amount
+		result.Count += c.Count
+		if !rph.ByCategory {
+			continue
+		}
+		if _, ok := perCategory[c.Category]; !ok {
+			perCategory[c.Category] = newSeries()
+			order = append(order, c.Category)
+		}
+		perCategory[c.Category][c.Bucket].Count += c.Count
+		perCategory[c.Category][c.Bucket].Amount += c.Amount
+	}
+
+	// служебные интервалы решаются по общей гистограмме - у всех категорий одинаковый набор интервалов
+	from, to := 0, n+2
+	if total[0].Count == 0 {
+		from++
+	}
+	if total[n+1].Count == 0 {
+		to--
+	}
+	result.Buckets = total[from:to]
+	for _, category := range order {
+		series := model.HistogramSeries{Category: category, Buckets: perCategory[category][from:to]}
+		for _, b := range series.Buckets {
+			series.Count += b.Count
+		}
+		result.Categories = append(result.Categories, series)
+	}
+	return result
+}
+
+// histogramBounds - границы интервала i: по edges или равные доли отрезка [min, max] выборки
+func histogramBounds(rph *model.RequestParamHistogram, cell model.HistogramCell, i int) (lower, upper *float64) {
+	n := *rph.Buckets
+	if len(rph.EdgeValues) > 0 {
+		if i > 0 {
+			v := float64(rph.EdgeValues[i-1])
+			lower = &v
+		}
+		if i <= n {
+			v := float64(rph.EdgeValues[i])
+			upper = &v
+		}
+		return lower, upper
+	}
+
+	width := (cell.Max - cell.Min) / float64(n)
+	lo, hi := cell.Min+float64(i-1)*width, cell.Min+float64(i)*width
+	if i == n {
+		hi = cell.Max // без накопленной ошибки округления
+	}
+	return &lo, &hi
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// bounds переводит границы интервалов в значения, null - -1
+func bounds(buckets []model.HistogramBucket) [][2]float64 {
+	result := make([][2]float64, 0, len(buckets))
+	for _, b := range buckets {
+		pair := [2]float64{-1, -1}
+		if b.Lower != nil {
+			pair[0] = *b.Lower
+		}
+		if b.Upper != nil {
+			pair[1] = *b.Upper
+		}
+		result = append(result, pair)
+	}
+	return result
+}
+
+func counts(buckets []model.HistogramBucket) []int {
+	result := make([]int, 0, len(buckets))
+	for _, b := range buckets {
+		result = append(result, b.Count)
+	}
+	return result
+}
+
+func TestBuildHistogram(t *testing.T) {
+	type series struct {
+		category string
+		counts   []int
+		count    int
+	}
+
+	tests := []struct {
+		name       string
+		buckets    int
+		edges      []int64
+		byCategory bool
+		cells      []model.HistogramCell
+		wantBounds [][2]float64
+		wantCounts []int
+		wantCount  int
+		wantSeries []series // у каждой категории тот же набор интервалов, что и у общей гистограммы
+	}{
+		{
+			name:       "inside edges",
+			edges:      []int64{0, 1000, 5000},
+			cells:      []model.HistogramCell{{Bucket: 1, Count: 2, Amount: 900}, {Bucket: 2, Count: 1, Amount: 3000}},
+			wantBounds: [][2]float64{{0, 1000}, {1000, 5000}},
+			wantCounts: []int{2, 1},
+			wantCount:  3,
+		},
+		{
+			name:       "above last edge",
+			edges:      []int64{0, 1000, 5000},
+			cells:      []model.HistogramCell{{Bucket: 1, Count: 1, Amount: 500}, {Bucket: 3, Count: 4, Amount: 40000}},
+			wantBounds: [][2]float64{{0, 1000}, {1000, 5000}, {5000, -1}},
+			wantCounts: []int{1, 0, 4},
+			wantCount:  5,
+		},
+		{
+			name:       "below first and above last edge",
+			edges:      []int64{0, 1000, 5000},
+			cells:      []model.HistogramCell{{Bucket: 0, Count: 1}, {Bucket: 2, Count: 1}, {Bucket: 3, Count: 1}},
+			wantBounds: [][2]float64{{-1, 0}, {0, 1000}, {1000, 5000}, {5000, -1}},
+			wantCounts: []int{1, 0, 1, 1},
+			wantCount:  3,
+		},
+		{
+			name:    "equal width",
+			buckets: 3,
+			cells: []model.HistogramCell{
+				{Bucket: 1, Count: 3, Amount: 450, Min: 100, Max: 400},
+				{Bucket: 3, Count: 1, Amount: 400, Min: 100, Max: 400},
+			},
+			wantBounds: [][2]float64{{100, 200}, {200, 300}, {300, 400}},
+			wantCounts: []int{3, 0, 1},
+			wantCount:  4,
+		},
+		{
+			// одна сумма в выборке: ширина нулевая, все операции в первом интервале
+			name:       "single amount",
+			buckets:    2,
+			cells:      []model.HistogramCell{{Bucket: 1, Count: 5, Amount: 2500, Min: 500, Max: 500}},
+			wantBounds: [][2]float64{{500, 500}, {500, 500}},
+			wantCounts: []int{5, 0},
+			wantCount:  5,
+		},
+		{
+			name:       "by category",
+			edges:      []int64{0, 1000},
+			byCategory: true,
+			cells: []model.HistogramCell{
+				{Category: "food", Bucket: 1, Count: 2, Amount: 800},
+				{Category: "health", Bucket: 2, Count: 1, Amount: 7000},
+				{Category: "food", Bucket: 2, Count: 1, Amount: 1500},
+			},
+			wantBounds: [][2]float64{{0, 1000}, {1000, -1}},
+			wantCounts: []int{2, 2},
+			wantCount:  4,
+			wantSeries: []series{{"food", []int{2, 1}, 3}, {"health", []int{0, 1}, 1}},
+		},
+		{
+			name:       "empty",
+			buckets:    20,
+			byCategory: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opType, buckets := model.OpTypeCredit, tt.buckets
+			if tt.edges != nil {
+				buckets = len(tt.edges) - 1
+			}
+			req := &model.RequestParamHistogram{
+				OperationFilter: model.OperationFilter{Type: &opType},
+				Buckets:         &buckets,
+				EdgeValues:      tt.edges,
+				ByCategory:      tt.byCategory,
+			}
+
+			got := buildHistogram(req, tt.cells)
+			if got.Buckets == nil {
+				t.Fatal("buckets is nil, want empty slice")
+			}
+			if b := bounds(got.Buckets); !slices.Equal(b, tt.wantBounds) {
+				t.Errorf("bounds = %v, want %v", b, tt.wantBounds)
+			}
+			if c := counts(got.Buckets); !slices.Equal(c, tt.wantCounts) || got.Count != tt.wantCount {
+				t.Errorf("counts = %v (total %d), want %v (total %d)", c, got.Count, tt.wantCounts, tt.wantCount)
+			}
+
+			// категории идут в порядке появления в строках запроса
+			if len(got.Categories) != len(tt.wantSeries) {
+				t.Fatalf("categories = %+v, want %d", got.Categories, len(tt.wantSeries))
+			}
+			for i, want := range tt.wantSeries {
+				s := got.Categories[i]
+				if s.Category != want.category || s.Count != want.count {
+					t.Errorf("[%d] category = %q (count %d), want %q (count %d)", i, s.Category, s.Count, want.category, want.count)
+				}
+				if b := bounds(s.Buckets); !slices.Equal(b, tt.wantBounds) {
+					t.Errorf("%s bounds = %v, want %v", s.Category, b, tt.wantBounds)
+				}
+				if c := counts(s.Buckets); !slices.Equal(c, want.counts) {
+					t.Errorf("%s counts = %v, want %v", s.Category, c, want.counts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// mergeOperationPatch применяет JSON Merge Patch (RFC 7396) к текущему состоянию операции
+// и возвращает результат в "входном" виде - с положительной суммой, как при создании
+func mergeOperationPatch(current *model.Operation, patch []byte) (*model.Operation, error) {
+	// в БД расход хранится с минусом - приводим к виду, в котором операцию присылает клиент
+	base := *current
+	if base.Amount < 0 {
+		base.Amount = base.Amount * -1
+	}
+
+	baseRaw, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+
+	var target any
+	if err := decodeJSONNumbers(baseRaw, &target); err != nil {
+		return nil, err
+	}
+	var patchDoc any
+	if err := decodeJSONNumbers(patch, &patchDoc); err != nil {
+		return nil, model.ErrInvalidPatch
+	}
+	// патч ресурса-операции обязан быть объектом, иначе он заменил бы документ целиком
+	if _, ok := patchDoc.(map[string]any); !ok {
+		return nil, model.ErrInvalidPatch
+	}
+
+	mergedRaw, err := json.Marshal(applyMergePatch(target, patchDoc))
+	if err != nil {
+		return nil, err
+	}
+
+	var result model.Operation
+	if err := json.Unmarshal(mergedRaw, &result); err != nil {
+		return nil, model.ErrInvalidPatch
+	}
+	// идентификатор и время создания патчем не меняются
+	result.ID = current.ID
+	result.CreatedAt = current.CreatedAt
+
+	return &result, nil
+}
+
+// applyMergePatch - алгоритм MergePatch из RFC 7396: null удаляет поле, объекты сливаются рекурсивно,
+// все остальные значения заменяют целевые целиком
+func applyMergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any, len(patchObj))
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+			continue
+		}
+		targetObj[k] = applyMergePatch(targetObj[k], v)
+	}
+
+	return targetObj
+}
+
+// decodeJSONNumbers декодирует JSON, сохраняя числа как json.Number - чтобы не терять точность int64 копеек
+func decodeJSONNumbers(raw []byte, dst any) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	return decoder.Decode(dst)
+}
@@ -2,34 +2,129 @@ package service
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/UnendingLoop/SalesTracker/internal/filterql"
 	"github.com/UnendingLoop/SalesTracker/internal/model"
 	"github.com/UnendingLoop/SalesTracker/internal/repository"
 )
 
 type OperationService struct {
-	repo repository.OperationsRepository
+	repo           repository.OperationsRepository
+	idempotencyTTL time.Duration  // сколько хранится результат запроса с Idempotency-Key
+	analyticsLoc   *time.Location // зона для интервалов аналитики, если в запросе нет tz
+	weekStart      string         // начало недели для group_by=week, если в запросе нет week_start
 }
 
-func NewOperationService(repo repository.OperationsRepository) *OperationService {
-	return &OperationService{repo: repo}
+const maxIdempotencyKeyLen = 255
+
+func NewOperationService(repo repository.OperationsRepository, idempotencyTTL time.Duration, analyticsLoc *time.Location, weekStart string) *OperationService {
+	return &OperationService{repo: repo, idempotencyTTL: idempotencyTTL, analyticsLoc: analyticsLoc, weekStart: weekStart}
 }
 
-func (svc *OperationService) CreateOperation(ctx context.Context, newOp *model.Operation) error {
+// CreateOperation создает операцию. С idempotencyKey вторым значением возвращается ответ, сохраненный при первом запросе, -
+// транспорт отдает его как есть
+func (svc *OperationService) CreateOperation(ctx context.Context, newOp *model.Operation, idempotencyKey string) (*model.Operation, *model.IdempotentResponse, error) {
 	// валидация входящей операции
 	if err := validateOperation(newOp); err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	if idempotencyKey != "" {
+		return svc.createOperationIdempotent(ctx, newOp, idempotencyKey)
 	}
 
-	// отправляем в репо
+	// отправляем в репо - он вернет операцию в том виде, в каком она сохранена
 	if err := svc.repo.Create(ctx, newOp); err != nil {
 		log.Printf("Failed to create new operation in DB: %q", err.Error())
-		return model.ErrCommon500
+		return nil, nil, model.ErrCommon500
 	}
 
-	return nil
+	return newOp, nil, nil
+}
+
+func (svc *OperationService) createOperationIdempotent(ctx context.Context, newOp *model.Operation, key string) (*model.Operation, *model.IdempotentResponse, error) {
+	if len(key) > maxIdempotencyKeyLen {
+		return nil, nil, model.ErrInvalidIdempotencyKey
+	}
+	hash, err := operationFingerprint(newOp)
+	if err != nil {
+		log.Printf("Failed to fingerprint operation payload: %q", err.Error())
+		return nil, nil, model.ErrCommon500
+	}
+
+	// ключ уже использовался в пределах окна - отдаем сохраненный результат
+	res, resp, err := svc.replayIdempotencyKey(ctx, key, hash)
+	if !errors.Is(err, model.ErrIdempotencyKeyNotFound) {
+		return res, resp, err
+	}
+
+	// создаем операцию и запоминаем ключ вместе с ответом в одной транзакции
+	err = svc.repo.InTx(ctx, func(repo repository.OperationsRepository) error {
+		if err := repo.Create(ctx, newOp); err != nil {
+			return err
+		}
+		body, err := json.Marshal(newOp)
+		if err != nil {
+			return err
+		}
+		resp = &model.IdempotentResponse{Status: http.StatusCreated, Body: body}
+		return repo.SaveIdempotencyKey(ctx, &model.IdempotencyRecord{Key: key, RequestHash: hash, OperationID: newOp.ID, Response: resp}, svc.idempotencyTTL)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrIdempotencyKeyExists):
+			// параллельный запрос с тем же ключом успел раньше - наша вставка откатилась
+			return svc.replayIdempotencyKey(ctx, key, hash)
+		default:
+			log.Printf("Failed to create new operation with idempotency key in DB: %q", err.Error())
+			return nil, nil, model.ErrCommon500
+		}
+	}
+
+	return newOp, resp, nil
+}
+
+// replayIdempotencyKey возвращает ответ первого запроса - не текущее состояние операции, которую могли изменить или удалить
+func (svc *OperationService) replayIdempotencyKey(ctx context.Context, key, hash string) (*model.Operation, *model.IdempotentResponse, error) {
+	rec, err := svc.repo.GetIdempotencyKey(ctx, key, svc.idempotencyTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrIdempotencyKeyNotFound):
+			return nil, nil, err
+		default:
+			log.Printf("Failed to get idempotency key from DB: %q", err.Error())
+			return nil, nil, model.ErrCommon500
+		}
+	}
+
+	if rec.RequestHash != hash {
+		return nil, nil, model.ErrIdempotencyKeyReused
+	}
+
+	// ключ сохранен до появления колонок ответа - остается только перечитать операцию
+	if rec.Response == nil {
+		op, err := svc.GetOperationByID(ctx, int(rec.OperationID))
+		return op, nil, err
+	}
+
+	var op model.Operation
+	if err := json.Unmarshal(rec.Response.Body, &op); err != nil {
+		log.Printf("Failed to decode stored idempotent response: %q", err.Error())
+		return nil, nil, model.ErrCommon500
+	}
+	return &op, rec.Response, nil
 }
 
 func (svc *OperationService) GetOperationByID(ctx context.Context, id int) (*model.Operation, error) {
@@ -58,6 +153,7 @@ func (svc *OperationService) GetAllOperations(ctx context.Context, rpo *model.Re
 	if err := validateOperationReqParams(rpo); err != nil {
 		return nil, err
 	}
+	applyDefaultSort(rpo)
 
 	// идем в репо
 	res, err := svc.repo.List(ctx, rpo)
@@ -69,21 +165,148 @@ func (svc *OperationService) GetAllOperations(ctx context.Context, rpo *model.Re
 	return res, nil
 }
 
-func (svc *OperationService) UpdateOperationByID(ctx context.Context, op *model.Operation) error {
-	if op.ID <= 0 {
-		return model.ErrInvalidID
+func (svc *OperationService) GetOperationsEnvelope(ctx context.Context, rpo *model.RequestParamOperations) (*model.OperationsEnvelope, error) {
+	// валидация параметров
+	if err := validateOperationReqParams(rpo); err != nil {
+		return nil, err
+	}
+
+	// в конверте страница всегда ограничена - подставляем значения по умолчанию
+	if rpo.Page == nil {
+		page := 1
+		rpo.Page = &page
+	}
+	if rpo.Limit == nil {
+		limit := model.DefaultPageLimit
+		rpo.Limit = &limit
+	}
+	applyDefaultSort(rpo)
+
+	// идем в репо
+	res, err := svc.repo.ListEnvelope(ctx, rpo)
+	if err != nil {
+		log.Printf("Failed to get operations envelope from DB: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return res, nil
+}
+
+func (svc *OperationService) GetOperationsPage(ctx context.Context, rpo *model.RequestParamOperations) (*model.OperationsPage, error) {
+	// валидация параметров
+	if err := validateOperationReqParams(rpo); err != nil {
+		return nil, err
 	}
+	if rpo.Page != nil {
+		return nil, model.ErrCursorWithPage
+	}
+	applyDefaultSort(rpo)
+
 	// идем в репо
+	res, err := svc.repo.ListPage(ctx, rpo)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrInvalidCursor):
+			return nil, err
+		default:
+			log.Printf("Failed to get operations page from DB: %q", err.Error())
+			return nil, model.ErrCommon500
+		}
+	}
+
+	return res, nil
+}
+
+func (svc *OperationService) SearchOperations(ctx context.Context, rps *model.RequestParamSearch) ([]model.SearchHit, error) {
+	// q в поиске - это поисковая строка, а не выражение языка фильтров
+	rps.Query = nil
+	rps.Terms = searchTerms(rps.Text)
+	if len(rps.Terms) == 0 {
+		return nil, model.ErrInvalidSearchQuery
+	}
+	if err := validateOperationReqParams(&rps.RequestParamOperations); err != nil {
+		return nil, err
+	}
+
+	// идем в репо
+	res, err := svc.repo.Search(ctx, rps)
+	if err != nil {
+		log.Printf("Failed to search operations in DB: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return res, nil
+}
+
+func (svc *OperationService) ReplaceOperationByID(ctx context.Context, op *model.Operation) (*model.Operation, error) {
+	if op.ID <= 0 {
+		return nil, model.ErrInvalidID
+	}
+	// полная замена проходит ту же валидацию, что и создание, включая смену знака для расхода
+	if err := validateOperation(op); err != nil {
+		return nil, err
+	}
+
+	// идем в репо - он вернет операцию после обновления
 	if err := svc.repo.Update(ctx, op); err != nil {
 		switch {
 		case errors.Is(err, model.ErrUnknownActorOrCategory) || errors.Is(err, model.ErrOperationIDNotFound):
-			return err
+			return nil, err
 		default:
 			log.Printf("Failed to update operation by ID in DB: %q", err.Error())
-			return model.ErrCommon500
+			return nil, model.ErrCommon500
 		}
 	}
-	return nil
+	return op, nil
+}
+
+func (svc *OperationService) PatchOperationByID(ctx context.Context, id int64, patch []byte) (*model.Operation, error) {
+	if id <= 0 {
+		return nil, model.ErrInvalidID
+	}
+
+	// чтение, слияние и запись - в одной транзакции под блокировкой строки, иначе параллельные патчи затирают друг друга
+	var res *model.Operation
+	var patchErr error
+	err := svc.repo.InTx(ctx, func(repo repository.OperationsRepository) error {
+		res, patchErr = svc.withRepo(repo).patchLocked(ctx, id, patch)
+		return patchErr
+	})
+	if patchErr != nil {
+		return nil, patchErr
+	}
+	if err != nil {
+		log.Printf("Failed to commit operation patch in DB: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+	return res, nil
+}
+
+// patchLocked накладывает патч на операцию; svc.repo должен быть транзакционным
+func (svc *OperationService) patchLocked(ctx context.Context, id int64, patch []byte) (*model.Operation, error) {
+	// берем текущее состояние операции и держим строку до коммита
+	current, err := svc.repo.GetForUpdate(ctx, int(id))
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrOperationIDNotFound):
+			return nil, err
+		default:
+			log.Printf("Failed to lock operation by ID in DB: %q", err.Error())
+			return nil, model.ErrCommon500
+		}
+	}
+
+	// накладываем патч и отправляем результат на полную замену - с полной валидацией
+	merged, err := mergeOperationPatch(current, patch)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidPatch) {
+			return nil, err
+		}
+		log.Printf("Failed to apply merge patch to operation: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return svc.ReplaceOperationByID(ctx, merged)
 }
 
 func (svc *OperationService) DeleteOperationByID(ctx context.Context, id int) error {
@@ -104,11 +327,142 @@ func (svc *OperationService) DeleteOperationByID(ctx context.Context, id int) er
 	return nil
 }
 
+func (svc *OperationService) BatchOperations(ctx context.Context, req *model.BatchRequest) (*model.BatchResult, []error, error) {
+	// валидация батча
+	if req.Mode == "" {
+		req.Mode = model.BatchAtomic
+	}
+	if _, ok := model.BatchModeMap[req.Mode]; !ok {
+		return nil, nil, model.ErrInvalidBatchMode
+	}
+	if len(req.Commands) == 0 || len(req.Commands) > model.MaxBatchSize {
+		return nil, nil, model.ErrInvalidBatchSize
+	}
+
+	result := &model.BatchResult{Mode: req.Mode, Results: make([]model.BatchItemResult, len(req.Commands))}
+	itemErrs := make([]error, len(req.Commands)) // ошибки команд по индексам Results - по ним транспорт проставляет Status
+	for i, cmd := range req.Commands {
+		result.Results[i] = model.BatchItemResult{Index: i, Action: cmd.Action}
+	}
+
+	// все команды выполняются в одной транзакции
+	failed := -1
+	err := svc.repo.InTx(ctx, func(repo repository.OperationsRepository) error {
+		for i := range req.Commands {
+			item := &result.Results[i]
+			if req.Mode == model.BatchBestEffort {
+				// каждая команда в своем savepoint - ее ошибка не откатывает остальные
+				itemErrs[i] = repo.InTx(ctx, func(sp repository.OperationsRepository) error {
+					var err error
+					item.Operation, err = svc.withRepo(sp).execBatchCommand(ctx, &req.Commands[i])
+					return err
+				})
+				continue
+			}
+
+			item.Operation, itemErrs[i] = svc.withRepo(repo).execBatchCommand(ctx, &req.Commands[i])
+			if itemErrs[i] != nil {
+				failed = i
+				return itemErrs[i]
+			}
+		}
+		return nil
+	})
+
+	switch {
+	case failed >= 0:
+		// atomic: транзакция откатилась - ни одна команда, кроме упавшей, не применена
+		for i := range result.Results {
+			if i != failed {
+				result.Results[i].Operation = nil
+				itemErrs[i] = model.ErrBatchAborted
+			}
+		}
+	case err != nil:
+		log.Printf("Failed to commit operations batch in DB: %q", err.Error())
+		return nil, nil, model.ErrCommon500
+	}
+
+	return result, itemErrs, nil
+}
+
+func (svc *OperationService) execBatchCommand(ctx context.Context, cmd *model.BatchCommand) (*model.Operation, error) {
+	switch cmd.Action {
+	case model.BatchCreate:
+		var op model.Operation
+		if err := json.Unmarshal(cmd.Data, &op); err != nil {
+			return nil, model.ErrInvalidBatchData
+		}
+		res, _, err := svc.CreateOperation(ctx, &op, "")
+		return res, err
+	case model.BatchUpdate:
+		var op model.Operation
+		if err := json.Unmarshal(cmd.Data, &op); err != nil {
+			return nil, model.ErrInvalidBatchData
+		}
+		op.ID = cmd.ID
+		return svc.ReplaceOperationByID(ctx, &op)
+	case model.BatchPatch:
+		return svc.PatchOperationByID(ctx, cmd.ID, cmd.Data)
+	case model.BatchDelete:
+		return nil, svc.DeleteOperationByID(ctx, int(cmd.ID))
+	default:
+		return nil, model.ErrInvalidBatchAction
+	}
+}
+
+// withRepo возвращает копию сервиса поверх другого репо - например, привязанного к транзакции
+func (svc *OperationService) withRepo(repo repository.OperationsRepository) *OperationService {
+	clone := *svc
+	clone.repo = repo
+	return &clone
+}
+
+func (svc *OperationService) BulkUpdateOperations(ctx context.Context, req *model.BulkUpdateRequest) (*model.BulkUpdateResult, error) {
+	// валидация фильтра: пустой фильтр изменил бы все операции разом
+	if err := validateOperationFilter(&req.Filter); err != nil {
+		return nil, err
+	}
+	if isEmptyFilter(&req.Filter) {
+		return nil, model.ErrEmptyBulkFilter
+	}
+
+	// валидация изменений
+	if err := validateBulkUpdateSet(&req.Set); err != nil {
+		return nil, err
+	}
+
+	// dry-run: только считаем и показываем первые подходящие операции
+	if req.DryRun {
+		matched, preview, err := svc.repo.BulkUpdatePreview(ctx, &req.Filter, model.BulkPreviewLimit)
+		if err != nil {
+			log.Printf("Failed to preview bulk update in DB: %q", err.Error())
+			return nil, model.ErrCommon500
+		}
+		return &model.BulkUpdateResult{DryRun: true, Matched: matched, Preview: preview}, nil
+	}
+
+	// идем в репо
+	updated, err := svc.repo.BulkUpdate(ctx, &req.Filter, &req.Set)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidTags) {
+			return nil, err
+		}
+		log.Printf("Failed to bulk update operations in DB: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return &model.BulkUpdateResult{Matched: updated, Updated: updated}, nil
+}
+
 func (svc *OperationService) GetAnalytics(ctx context.Context, rpa *model.RequestParamAnalytics) (*model.AnalyticsSummary, error) {
 	// валидируем параметры запроса
 	if rpa == nil {
 		rpa = &model.RequestParamAnalytics{}
 	}
+	if err := svc.resolveTimeBuckets(&rpa.TimeBuckets); err != nil {
+		return nil, err
+	}
 	if err := validateAnalyticsReqParams(rpa); err != nil {
 		return nil, err
 	}
@@ -120,22 +474,294 @@ func (svc *OperationService) GetAnalytics(ctx context.Context, rpa *model.Reques
 		return nil, model.ErrCommon500
 	}
 
-	if rpa.GroupBy == nil {
+	summary.StatKeys = rpa.ExtraStats
+
+	if len(rpa.Dimensions) > 0 {
+		// если запрос с группировкой - делаем и его
+		groups, err := svc.repo.AnalyticsGroup(ctx, rpa)
+		if err != nil {
+			log.Printf("analytics group query failed: %q", err.Error())
+			return nil, model.ErrCommon500
+		}
+
+		// при fill=null пустые интервалы отдаются с null вместо нулей
+		if rpa.Fill != nil && *rpa.Fill == model.FillNull {
+			for i := range groups {
+				groups[i].Gap = groups[i].Count == 0
+			}
+		}
+
+		// скользящие средние и тренд - по уже полученным группам
+		if trendRequested(rpa) {
+			applyTrend(rpa, groups)
+			summary.TrendKeys = trendKeys(rpa)
+			summary.TrendMetric = model.MetricSum
+			if rpa.TrendMetric != nil {
+				summary.TrendMetric = *rpa.TrendMetric
+			}
+		}
+
+		// собираем воедино
+		summary.Groups = groups
+		summary.Key = strings.Join(rpa.Dimensions, ",")
+	}
+
+	if rpa.Compare == nil {
 		return summary, nil
 	}
-	// если запрос с группировкой - делаем и его
-	groups, err := svc.repo.AnalyticsGroup(ctx, rpa)
+
+	// те же запросы по окну сравнения
+	w := defineCompareWindow(*rpa.Compare, *rpa.StartTime, *rpa.EndTime, rpa.Location, *rpa.WeekStart)
+	prevParams := *rpa
+	prevParams.StartTime, prevParams.EndTime = &w.from, &w.to
+	prev, err := svc.repo.AnalyticsSummary(ctx, &prevParams)
 	if err != nil {
-		log.Printf("analytics group query failed: %q", err.Error())
+		log.Printf("analytics compare summary query failed: %q", err.Error())
 		return nil, model.ErrCommon500
 	}
+	if len(rpa.Dimensions) > 0 {
+		prev.Groups, err = svc.repo.AnalyticsGroup(ctx, &prevParams)
+		if err != nil {
+			log.Printf("analytics compare group query failed: %q", err.Error())
+			return nil, model.ErrCommon500
+		}
+	}
 
-	// собираем воедино
-	summary.Groups = groups
-	summary.Key = *rpa.GroupBy
+	summary.Comparison = buildComparison(*rpa.Compare, w, rpa.Dimensions, summary, prev)
 	return summary, nil
 }
 
+func (svc *OperationService) GetAnalyticsPivot(ctx context.Context, rpp *model.RequestParamPivot) (*model.PivotTable, error) {
+	// валидируем параметры запроса
+	if err := svc.resolveTimeBuckets(&rpp.TimeBuckets); err != nil {
+		return nil, err
+	}
+	if err := validatePivotReqParams(rpp); err != nil {
+		return nil, err
+	}
+
+	cells, err := svc.repo.AnalyticsPivot(ctx, rpp)
+	if err != nil {
+		log.Printf("analytics pivot query failed: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return buildPivotTable(rpp, cells), nil
+}
+
+// buildPivotTable раскладывает строки GROUPING SETS по матрице; все значения, включая итоги, посчитаны в БД -
+// медиану и p90 итогов нельзя получить из значений ячеек
+func buildPivotTable(rpp *model.RequestParamPivot, cells []model.PivotCell) *model.PivotTable {
+	table := &model.PivotTable{
+		Rows:      *rpp.Rows,
+		Cols:      *rpp.Cols,
+		Metric:    *rpp.Metric,
+		RowKeys:   make([]string, 0),
+		ColKeys:   make([]string, 0),
+		RowTotals: make([]float64, 0),
+		ColTotals: make([]float64, 0),
+	}
+
+	// ключи берем из итоговых строк - они уже отсортированы запросом
+	rowIdx := make(map[string]int)
+	colIdx := make(map[string]int)
+	for _, c := range cells {
+		var value float64
+		if c.Value != nil {
+			value = *c.Value
+		}
+		switch {
+		case c.RowTotal && c.ColTotal:
+			table.GrandTotal = value
+		case c.RowTotal:
+			rowIdx[c.Row] = len(table.RowKeys)
+			table.RowKeys = append(table.RowKeys, c.Row)
+			table.RowTotals = append(table.RowTotals, value)
+		case c.ColTotal:
+			colIdx[c.Col] = len(table.ColKeys)
+			table.ColKeys = append(table.ColKeys, c.Col)
+			table.ColTotals = append(table.ColTotals, value)
+		}
+	}
+
+	table.Cells = make([][]*float64, len(table.RowKeys))
+	for i := range table.Cells {
+		table.Cells[i] = make([]*float64, len(table.ColKeys))
+	}
+	for _, c := range cells {
+		if c.RowTotal || c.ColTotal {
+			continue
+		}
+		table.Cells[rowIdx[c.Row]][colIdx[c.Col]] = c.Value
+	}
+
+	return table
+}
+
+func (svc *OperationService) GetCashflow(ctx context.Context, rpc *model.RequestParamCashflow) (*model.Cashflow, error) {
+	// валидируем параметры запроса
+	if err := svc.resolveTimeBuckets(&rpc.TimeBuckets); err != nil {
+		return nil, err
+	}
+	if rpc.Interval == nil {
+		interval := model.GroupByMonth
+		rpc.Interval = &interval
+	}
+	if _, ok := model.CashflowIntervalMap[*rpc.Interval]; !ok {
+		return nil, model.ErrInvalidInterval
+	}
+	if rpc.OpeningBalance == nil {
+		var zero int64
+		rpc.OpeningBalance = &zero
+	}
+	if err := validateOperationFilter(&rpc.OperationFilter); err != nil {
+		return nil, err
+	}
+	// каждый интервал окна выводится, даже без операций - окно ограничено, как у fill
+	if rpc.StartTime != nil && rpc.EndTime != nil {
+		if n, _ := countBuckets(*rpc.Interval, *rpc.StartTime, *rpc.EndTime); n > model.MaxFillBuckets {
+			return nil, model.ErrInvalidCashflowWindow
+		}
+	}
+
+	buckets, err := svc.repo.AnalyticsCashflow(ctx, rpc)
+	if err != nil {
+		log.Printf("analytics cashflow query failed: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	result := &model.Cashflow{
+		Interval:       *rpc.Interval,
+		OpeningBalance: *rpc.OpeningBalance,
+		ClosingBalance: *rpc.OpeningBalance,
+		Buckets:        buckets,
+	}
+	if len(buckets) > 0 {
+		result.ClosingBalance = buckets[len(buckets)-1].Balance
+	}
+
+	return result, nil
+}
+
+func (svc *OperationService) GetForecast(ctx context.Context, rpf *model.RequestParamForecast) (*model.Forecast, error) {
+	// валидируем параметры запроса
+	if err := svc.resolveTimeBuckets(&rpf.TimeBuckets); err != nil {
+		return nil, err
+	}
+	if err := validateForecast(rpf); err != nil {
+		return nil, err
+	}
+
+	// история - полные месяцы до текущего, плюс текущий месяц на момент запроса
+	now := time.Now().In(rpf.Location)
+	currentMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, rpf.Location)
+	historyFrom := currentMonth.AddDate(0, -*rpf.History, 0)
+	rpf.StartTime, rpf.EndTime = &historyFrom, &now
+
+	aggs, err := svc.repo.AnalyticsMonthlyByCategory(ctx, rpf)
+	if err != nil {
+		log.Printf("analytics forecast query failed: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return buildForecast(aggs, historyFrom, *rpf.History, *rpf.Months), nil
+}
+
+func (svc *OperationService) GetTop(ctx context.Context, rpt *model.RequestParamTop) (*model.TopBreakdown, error) {
+	// валидируем параметры запроса
+	if err := svc.resolveTimeBuckets(&rpt.TimeBuckets); err != nil {
+		return nil, err
+	}
+	if err := validateTop(rpt); err != nil {
+		return nil, err
+	}
+
+	groups, err := svc.repo.AnalyticsTop(ctx, rpt)
+	if err != nil {
+		log.Printf("analytics top query failed: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return buildTopBreakdown(rpt, groups), nil
+}
+
+func (svc *OperationService) GetHistogram(ctx context.Context, rph *model.RequestParamHistogram) (*model.Histogram, error) {
+	// валидируем параметры запроса
+	if err := svc.resolveTimeBuckets(&rph.TimeBuckets); err != nil {
+		return nil, err
+	}
+	if err := validateHistogram(rph); err != nil {
+		return nil, err
+	}
+
+	cells, err := svc.repo.AnalyticsHistogram(ctx, rph)
+	if err != nil {
+		log.Printf("analytics histogram query failed: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return buildHistogram(rph, cells), nil
+}
+
+func (svc *OperationService) GetAnomalies(ctx context.Context, rpa *model.RequestParamAnomalies) (*model.Anomalies, error) {
+	// валидируем параметры запроса
+	if err := svc.resolveTimeBuckets(&rpa.TimeBuckets); err != nil {
+		return nil, err
+	}
+	if err := validateAnomalies(rpa, time.Now()); err != nil {
+		return nil, err
+	}
+
+	result, err := svc.repo.Anomalies(ctx, rpa)
+	if err != nil {
+		log.Printf("analytics anomalies query failed: %q", err.Error())
+		return nil, model.ErrCommon500
+	}
+
+	return result, nil
+}
+
+// AnalyticsLocation проверяет tz из запроса; без него - зона по умолчанию из конфига.
+// Транспорт читает в этой зоне from/to без смещения
+func (svc *OperationService) AnalyticsLocation(tz *string) (*time.Location, error) {
+	if tz == nil {
+		return svc.analyticsLoc, nil
+	}
+	return loadTimeZone(*tz)
+}
+
+func (svc *OperationService) resolveTimeBuckets(tb *model.TimeBuckets) error {
+	loc, err := svc.AnalyticsLocation(tb.TZ)
+	if err != nil {
+		return err
+	}
+	tb.Location = loc
+
+	if tb.WeekStart == nil {
+		tb.WeekStart = &svc.weekStart
+	}
+	if _, ok := model.WeekStartMap[*tb.WeekStart]; !ok {
+		return model.ErrInvalidWeekStart
+	}
+
+	return nil
+}
+
+// loadTimeZone принимает только IANA-имена: "Local" зависит от сервера, а имя зоны уходит в SQL
+func loadTimeZone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" || strings.ContainsFunc(name, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("/_+-", r))
+	}) {
+		return nil, model.ErrInvalidTimeZone
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, model.ErrInvalidTimeZone
+	}
+	return loc, nil
+}
+
 func validateOperation(op *model.Operation) error {
 	if op.Amount <= 0 {
 		return model.ErrInvalidAmount
@@ -152,6 +778,18 @@ func validateOperation(op *model.Operation) error {
 	if op.OperationAt.IsZero() {
 		return model.ErrInvalidOpTime
 	}
+	tags, err := normalizeTags(op.Tags)
+	if err != nil {
+		return err
+	}
+	op.Tags = tags
+	if op.Account != nil {
+		account, ok := normalizeLabel(*op.Account)
+		if !ok {
+			return model.ErrInvalidAccount
+		}
+		op.Account = &account
+	}
 
 	if op.Type == model.OpTypeCredit {
 		op.Amount = op.Amount * -1
@@ -159,6 +797,183 @@ func validateOperation(op *model.Operation) error {
 	return nil
 }
 
+// operationFingerprint - хэш провалидированной операции: повтор с тем же ключом обязан совпадать с ним
+func operationFingerprint(op *model.Operation) (string, error) {
+	raw, err := json.Marshal(struct {
+		Amount      int64     `json:"amount"`
+		Actor       string    `json:"actor"`
+		Category    string    `json:"category"`
+		Type        string    `json:"type"`
+		OperationAt time.Time `json:"operation_at"`
+		Description *string   `json:"description"`
+		Tags        []string  `json:"tags"`
+		Account     *string   `json:"account"`
+	}{op.Amount, op.Actor, op.Category, op.Type, op.OperationAt.UTC(), op.Description, op.Tags, op.Account})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func validateOperationFilter(f *model.OperationFilter) error {
+	if f.StartTime != nil && f.EndTime != nil {
+		if f.StartTime.After(*f.EndTime) {
+			return model.ErrInvalidStartEndTime
+		}
+	}
+
+	// списки можно передавать и повтором параметра, и через запятую
+	f.Actors = splitListValues(f.Actors)
+	f.Categories = splitListValues(f.Categories)
+	f.Tags = splitListValues(f.Tags)
+	f.Accounts = splitListValues(f.Accounts)
+
+	// в фильтрах допустим и "other" - на него в БД могут ссылаться старые операции
+	for _, actor := range f.Actors {
+		if _, ok := model.ActorsMap[actor]; !ok && actor != model.FamOther {
+			return model.ErrInvalidActor
+		}
+	}
+	for _, category := range f.Categories {
+		if _, ok := model.CategoriesMap[category]; !ok && category != model.CatOther {
+			return model.ErrInvalidCategory
+		}
+	}
+	if f.Type != nil {
+		if _, ok := model.OpTypeMap[*f.Type]; !ok {
+			return model.ErrInvalidOpType
+		}
+	}
+	for i, tag := range f.Tags {
+		label, ok := normalizeLabel(tag)
+		if !ok {
+			return model.ErrInvalidTags
+		}
+		f.Tags[i] = label
+	}
+	for i, account := range f.Accounts {
+		label, ok := normalizeLabel(account)
+		if !ok {
+			return model.ErrInvalidAccount
+		}
+		f.Accounts[i] = label
+	}
+
+	// выражение на языке фильтров проверяем здесь, чтобы ошибка с позицией ушла клиенту как 400
+	if f.Query != nil {
+		if _, err := filterql.Parse(*f.Query); err != nil {
+			return err
+		}
+	}
+
+	if (f.AmountMin != nil && *f.AmountMin < 0) || (f.AmountMax != nil && *f.AmountMax < 0) {
+		return model.ErrInvalidAmountRange
+	}
+	if f.AmountMin != nil && f.AmountMax != nil && *f.AmountMin > *f.AmountMax {
+		return model.ErrInvalidAmountRange
+	}
+
+	return nil
+}
+
+func isEmptyFilter(f *model.OperationFilter) bool {
+	return f.StartTime == nil && f.EndTime == nil && len(f.Actors) == 0 && len(f.Categories) == 0 && f.Type == nil && f.Description == nil &&
+		f.AmountMin == nil && f.AmountMax == nil && f.Query == nil && len(f.Tags) == 0 && len(f.Accounts) == 0
+}
+
+// validateBulkUpdateSet проверяет изменения массового обновления и нормализует метки
+func validateBulkUpdateSet(set *model.BulkUpdateSet) error {
+	if set.Actor == nil && set.Category == nil && len(set.AddTags) == 0 && len(set.RemoveTags) == 0 {
+		return model.ErrEmptyBulkUpdate
+	}
+	if set.Actor != nil {
+		if _, ok := model.ActorsMap[*set.Actor]; !ok {
+			return model.ErrInvalidActor
+		}
+	}
+	if set.Category != nil {
+		if _, ok := model.CategoriesMap[*set.Category]; !ok {
+			return model.ErrInvalidCategory
+		}
+	}
+
+	var err error
+	if set.AddTags, err = normalizeTags(set.AddTags); err != nil {
+		return err
+	}
+	if set.RemoveTags, err = normalizeTags(set.RemoveTags); err != nil {
+		return err
+	}
+	// одна и та же метка в обоих списках - противоречивый запрос
+	for _, tag := range set.AddTags {
+		if slices.Contains(set.RemoveTags, tag) {
+			return model.ErrInvalidTags
+		}
+	}
+	return nil
+}
+
+// normalizeTags приводит метки операции к нижнему регистру и убирает повторы; пустой список - nil
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		label, ok := normalizeLabel(tag)
+		if !ok {
+			return nil, model.ErrInvalidTags
+		}
+		if !slices.Contains(result, label) {
+			result = append(result, label)
+		}
+	}
+	if len(result) > model.MaxOperationTags {
+		return nil, model.ErrInvalidTags
+	}
+	return result, nil
+}
+
+// normalizeLabel - метка или счет без пробелов по краям, в нижнем регистре. Запятая недопустима:
+// ей разделяются значения фильтров и метки при чтении из БД
+func normalizeLabel(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || utf8.RuneCountInString(s) > model.MaxLabelLen || strings.Contains(s, ",") {
+		return "", false
+	}
+	return s, true
+}
+
+func splitListValues(input []string) []string {
+	if len(input) == 0 {
+		return input
+	}
+
+	result := make([]string, 0, len(input))
+	for _, v := range input {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
+
+// searchTerms режет поисковую строку на слова из букв и цифр - остальное (в т.ч. операторы tsquery) отбрасывается
+func searchTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > model.MaxSearchTerms {
+		words = words[:model.MaxSearchTerms]
+	}
+	return words
+}
+
 func validateOperationReqParams(rpo *model.RequestParamOperations) error {
 	if rpo.OrderBy != nil {
 		// валидация самого OrderBy
@@ -169,48 +984,256 @@ func validateOperationReqParams(rpo *model.RequestParamOperations) error {
 		if rpo.ASC == rpo.DESC {
 			return model.ErrInvalidAscDesc
 		}
+		rpo.Sort = []model.SortKey{{Field: *rpo.OrderBy, Desc: rpo.DESC}}
 	}
 
-	if rpo.StartTime != nil && rpo.EndTime != nil {
-		if rpo.StartTime.After(*rpo.EndTime) {
-			return model.ErrInvalidStartEndTime
+	if rpo.SortSpec != nil {
+		if rpo.OrderBy != nil || rpo.ASC || rpo.DESC {
+			return model.ErrSortWithOrderBy
 		}
+		keys, err := parseSortSpec(*rpo.SortSpec)
+		if err != nil {
+			return err
+		}
+		rpo.Sort = keys
 	}
 
-	if rpo.Page != nil {
-		if *rpo.Page <= 0 {
-			return model.ErrInvalidPage
+	if err := validateOperationFilter(&rpo.OperationFilter); err != nil {
+		return err
+	}
+
+	if rpo.Pagination != nil && *rpo.Pagination != model.PaginationOffset && *rpo.Pagination != model.PaginationCursor {
+		return model.ErrInvalidPagination
+	}
+
+	if rpo.Page != nil && *rpo.Page <= 0 {
+		return model.ErrInvalidPage
+	}
+	if rpo.Limit != nil && (*rpo.Limit <= 0 || *rpo.Limit >= 1000) {
+		return model.ErrInvalidLimit
+	}
+
+	return nil
+}
+
+// parseSortSpec разбирает sort=-operation_at,amount,actor:nulls_first: "-" - по убыванию,
+// суффикс :nulls_first/:nulls_last допустим только для actor и category - остальные поля не бывают NULL
+func parseSortSpec(spec string) ([]model.SortKey, error) {
+	keys := make([]model.SortKey, 0)
+	seen := make(map[string]struct{})
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		key := model.SortKey{}
+
+		if field, nulls, ok := strings.Cut(part, ":"); ok {
+			if nulls != model.NullsFirst && nulls != model.NullsLast {
+				return nil, model.ErrInvalidSort
+			}
+			part, key.Nulls = field, nulls
+		}
+		if strings.HasPrefix(part, "-") {
+			part, key.Desc = part[1:], true
 		}
-		if *rpo.Limit <= 0 || *rpo.Limit >= 1000 {
-			return model.ErrInvalidLimit
+
+		if _, ok := model.OrderMap[part]; !ok {
+			return nil, model.ErrInvalidSort
+		}
+		if key.Nulls != "" && part != model.OrderByActor && part != model.OrderByCategory {
+			return nil, model.ErrInvalidSort
 		}
+		if _, dup := seen[part]; dup {
+			return nil, model.ErrInvalidSort
+		}
+		seen[part] = struct{}{}
+
+		key.Field = part
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// applyDefaultSort - без order_by/sort сначала свежие операции; id как тай-брейкер добавляет репо
+func applyDefaultSort(rpo *model.RequestParamOperations) {
+	if len(rpo.Sort) == 0 {
+		rpo.Sort = []model.SortKey{{Field: model.OrderByOpDate, Desc: true}}
+	}
+}
+
+// validateFill: заполнение пустых интервалов возможно только для одного временного измерения и ограниченного окна from/to
+func validateFill(rpa *model.RequestParamAnalytics) error {
+	if rpa.Fill == nil {
+		return nil
+	}
+	if _, ok := model.FillMap[*rpa.Fill]; !ok {
+		return model.ErrInvalidFill
+	}
+	if *rpa.Fill == model.FillNone {
+		return nil
+	}
+	if len(rpa.Dimensions) != 1 {
+		return model.ErrInvalidFill
+	}
+
+	from, to := rpa.StartTime, rpa.EndTime
+	if from == nil || to == nil || from.After(*to) {
+		return model.ErrInvalidFillWindow
+	}
+
+	buckets, ok := countBuckets(rpa.Dimensions[0], *from, *to)
+	if !ok {
+		return model.ErrInvalidFill
+	}
+	if buckets > model.MaxFillBuckets {
+		return model.ErrInvalidFillWindow
 	}
 
 	return nil
 }
 
-func validateAnalyticsReqParams(rpa *model.RequestParamAnalytics) error {
-	if rpa.GroupBy != nil {
-		// валидация самого groupby
-		if _, ok := model.GroupingMap[*rpa.GroupBy]; !ok {
-			return model.ErrInvalidGroupBy
+// countBuckets - сколько интервалов dim (с запасом на неполные края) покрывает окно from/to; false - не временное измерение
+func countBuckets(dim string, from, to time.Time) (int, bool) {
+	switch dim {
+	case model.GroupByDay:
+		return int(to.Sub(from).Hours()/24) + 1, true
+	case model.GroupByWeek:
+		return int(to.Sub(from).Hours()/(24*7)) + 2, true
+	case model.GroupByMonth:
+		return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month()) + 1, true
+	case model.GroupByYear:
+		return to.Year() - from.Year() + 1, true
+	default:
+		return 0, false
+	}
+}
+
+// parseExtraStats собирает ключи доп. статистики в порядке запроса: сначала перцентили (p25, p99.9), затем stats
+func parseExtraStats(percentiles, stats *string) ([]string, error) {
+	keys := make([]string, 0)
+
+	if percentiles != nil {
+		values := splitListValues([]string{*percentiles})
+		if len(values) == 0 || len(values) > model.MaxPercentiles {
+			return nil, model.ErrInvalidPercentiles
+		}
+		for _, v := range values {
+			p, err := strconv.ParseFloat(v, 64)
+			if err != nil || !(p > 0 && p < 100) { // так отсекается и NaN
+				return nil, model.ErrInvalidPercentiles
+			}
+			key := "p" + strconv.FormatFloat(p, 'f', -1, 64)
+			if slices.Contains(keys, key) {
+				return nil, model.ErrInvalidPercentiles
+			}
+			keys = append(keys, key)
 		}
 	}
 
-	if rpa.StartTime != nil && rpa.EndTime != nil {
-		if rpa.StartTime.After(*rpa.EndTime) {
-			return model.ErrInvalidStartEndTime
+	if stats != nil {
+		values := splitListValues([]string{*stats})
+		if len(values) == 0 {
+			return nil, model.ErrInvalidStats
 		}
+		for _, v := range values {
+			if _, ok := model.ExtraStatsMap[v]; !ok || slices.Contains(keys, v) {
+				return nil, model.ErrInvalidStats
+			}
+			keys = append(keys, v)
+		}
+	}
+
+	return keys, nil
+}
+
+func validatePivotReqParams(rpp *model.RequestParamPivot) error {
+	if rpp.Rows == nil || rpp.Cols == nil || *rpp.Rows == *rpp.Cols {
+		return model.ErrInvalidPivotDims
+	}
+	if _, ok := model.GroupingMap[*rpp.Rows]; !ok {
+		return model.ErrInvalidPivotDims
+	}
+	if _, ok := model.GroupingMap[*rpp.Cols]; !ok {
+		return model.ErrInvalidPivotDims
 	}
 
-	if rpa.Page != nil {
-		if *rpa.Page <= 0 {
-			return model.ErrInvalidPage
+	if rpp.Metric == nil {
+		metric := model.MetricSum
+		rpp.Metric = &metric
+	}
+	if _, ok := model.MetricMap[*rpp.Metric]; !ok {
+		return model.ErrInvalidMetric
+	}
+
+	return validateOperationFilter(&rpp.OperationFilter)
+}
+
+func validateAnalyticsReqParams(rpa *model.RequestParamAnalytics) error {
+	if rpa.GroupBy != nil {
+		// валидация самого groupby: до трех разных измерений через запятую
+		dims := splitListValues([]string{*rpa.GroupBy})
+		if len(dims) == 0 {
+			return model.ErrInvalidGroupBy
+		}
+		if len(dims) > model.MaxGroupByDims {
+			return model.ErrTooManyGroupBy
 		}
-		if *rpa.Limit <= 0 || *rpa.Limit >= 1000 {
-			return model.ErrInvalidLimit
+		for i, dim := range dims {
+			if _, ok := model.GroupingMap[dim]; !ok {
+				return model.ErrInvalidGroupBy
+			}
+			if slices.Contains(dims[:i], dim) {
+				return model.ErrInvalidGroupBy
+			}
 		}
+		rpa.Dimensions = dims
+	}
+
+	if err := validateOperationFilter(&rpa.OperationFilter); err != nil {
+		return err
+	}
+
+	extras, err := parseExtraStats(rpa.Percentiles, rpa.Stats)
+	if err != nil {
+		return err
+	}
+	rpa.ExtraStats = extras
+
+	if err := validateFill(rpa); err != nil {
+		return err
+	}
+
+	if rpa.Page != nil && *rpa.Page <= 0 {
+		return model.ErrInvalidPage
+	}
+	if rpa.Limit != nil && (*rpa.Limit <= 0 || *rpa.Limit >= 1000) {
+		return model.ErrInvalidLimit
+	}
+
+	if err := validateCompare(rpa); err != nil {
+		return err
+	}
+
+	if err := validateTrend(rpa); err != nil {
+		return err
 	}
 
 	return nil
 }
+
+// validateCompare: сравнение нужно с явным окном from/to, а страница групп в двух окнах была бы разной
+func validateCompare(rpa *model.RequestParamAnalytics) error {
+	if rpa.Compare == nil {
+		return nil
+	}
+	if _, ok := model.CompareMap[*rpa.Compare]; !ok {
+		return model.ErrInvalidCompare
+	}
+	if rpa.StartTime == nil || rpa.EndTime == nil || !rpa.StartTime.Before(*rpa.EndTime) {
+		return model.ErrInvalidCompare
+	}
+	if rpa.Page != nil || rpa.Limit != nil {
+		return model.ErrCompareWithPage
+	}
+	return nil
+}
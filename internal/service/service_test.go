@@ -0,0 +1,110 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+func TestValidateOperationLabels(t *testing.T) {
+	account := func(s string) *string { return &s }
+
+	tests := []struct {
+		name        string
+		tags        []string
+		account     *string
+		wantTags    []string
+		wantAccount *string
+		wantErr     error
+	}{
+		{name: "no labels"},
+		{name: "normalized", tags: []string{" Trip ", "work", "TRIP"}, account: account(" Card "), wantTags: []string{"trip", "work"}, wantAccount: account("card")},
+		{name: "empty tag", tags: []string{"trip", " "}, wantErr: model.ErrInvalidTags},
+		{name: "comma in tag", tags: []string{"a,b"}, wantErr: model.ErrInvalidTags},
+		{name: "long tag", tags: []string{strings.Repeat("я", model.MaxLabelLen+1)}, wantErr: model.ErrInvalidTags},
+		{name: "too many tags", tags: strings.Split("a,b,c,d,e,f,g,h,i,j,k", ","), wantErr: model.ErrInvalidTags},
+		{name: "repeats do not count", tags: strings.Split("a,b,c,d,e,f,g,h,i,j,A", ","), wantTags: strings.Split("a,b,c,d,e,f,g,h,i,j", ",")},
+		{name: "empty account", account: account("  "), wantErr: model.ErrInvalidAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := &model.Operation{
+				Amount: 1000, Actor: model.FamSon, Category: model.CatFood, Type: model.OpTypeCredit,
+				OperationAt: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), Tags: tt.tags, Account: tt.account,
+			}
+			err := validateOperation(op)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("validateOperation() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(op.Tags, tt.wantTags) {
+				t.Errorf("tags = %q, want %q", op.Tags, tt.wantTags)
+			}
+			if (op.Account == nil) != (tt.wantAccount == nil) || (op.Account != nil && *op.Account != *tt.wantAccount) {
+				t.Errorf("account = %v, want %v", op.Account, tt.wantAccount)
+			}
+		})
+	}
+}
+
+func TestValidateOperationFilterLabels(t *testing.T) {
+	f := model.OperationFilter{Tags: []string{"Trip,work", "school"}, Accounts: []string{"Card"}}
+	if err := validateOperationFilter(&f); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"trip", "work", "school"}; !slices.Equal(f.Tags, want) {
+		t.Errorf("tags = %q, want %q", f.Tags, want)
+	}
+	if want := []string{"card"}; !slices.Equal(f.Accounts, want) {
+		t.Errorf("accounts = %q, want %q", f.Accounts, want)
+	}
+	if isEmptyFilter(&f) {
+		t.Error("filter by tags and account is reported as empty")
+	}
+
+	long := model.OperationFilter{Accounts: []string{strings.Repeat("x", model.MaxLabelLen+1)}}
+	if err := validateOperationFilter(&long); !errors.Is(err, model.ErrInvalidAccount) {
+		t.Errorf("long account error = %v, want ErrInvalidAccount", err)
+	}
+}
+
+func TestValidateBulkUpdateSet(t *testing.T) {
+	son, pets := model.FamSon, "pets"
+
+	tests := []struct {
+		name       string
+		set        model.BulkUpdateSet
+		wantAdd    []string
+		wantRemove []string
+		wantErr    error
+	}{
+		{name: "nothing to change", wantErr: model.ErrEmptyBulkUpdate},
+		{name: "actor only", set: model.BulkUpdateSet{Actor: &son}},
+		{name: "unknown category", set: model.BulkUpdateSet{Category: &pets}, wantErr: model.ErrInvalidCategory},
+		{name: "tags only", set: model.BulkUpdateSet{AddTags: []string{"Trip", "trip"}, RemoveTags: []string{" old "}}, wantAdd: []string{"trip"}, wantRemove: []string{"old"}},
+		{name: "same tag added and removed", set: model.BulkUpdateSet{AddTags: []string{"trip"}, RemoveTags: []string{"TRIP"}}, wantErr: model.ErrInvalidTags},
+		{name: "invalid tag", set: model.BulkUpdateSet{RemoveTags: []string{"a,b"}}, wantErr: model.ErrInvalidTags},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBulkUpdateSet(&tt.set)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("validateBulkUpdateSet() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(tt.set.AddTags, tt.wantAdd) || !slices.Equal(tt.set.RemoveTags, tt.wantRemove) {
+				t.Errorf("tags = +%q -%q, want +%q -%q", tt.set.AddTags, tt.set.RemoveTags, tt.wantAdd, tt.wantRemove)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import "github.com/UnendingLoop/SalesTracker/internal/model"
+
+// validateTop проставляет значения по умолчанию: группировка по категории, первые 10, топ расходов
+func validateTop(rpt *model.RequestParamTop) error {
+	if rpt.By == nil {
+		by := model.GroupByCategory
+		rpt.By = &by
+	}
+	if _, ok := model.TopByMap[*rpt.By]; !ok {
+		return model.ErrInvalidTopParams
+	}
+	if rpt.N == nil {
+		n := model.DefaultTopN
+		rpt.N = &n
+	}
+	if *rpt.N < 1 || *rpt.N > model.MaxTopN {
+		return model.ErrInvalidTopParams
+	}
+	if rpt.Type == nil {
+		opType := model.OpTypeCredit
+		rpt.Type = &opType
+	}
+	return validateOperationFilter(&rpt.OperationFilter)
+}
+
+// buildTopBreakdown считает доли и сворачивает все, что не попало в первые n, в "прочие"
+func buildTopBreakdown(rpt *model.RequestParamTop, groups []model.TopGroup) *model.TopBreakdown {
+	result := &model.TopBreakdown{
+		By:    *rpt.By,
+		Type:  *rpt.Type,
+		N:     *rpt.N,
+		Items: make([]model.TopItem, 0, len(groups)),
+	}
+	if len(groups) == 0 {
+		return result
+	}
+	result.TotalAmount, result.TotalCount = groups[0].TotalAmount, groups[0].TotalCount
+	result.Groups, result.ParetoGroups = groups[0].Groups, groups[0].Pareto
+
+	share := func(amount float64) float64 {
+		if result.TotalAmount == 0 {
+			return 0
+		}
+		return amount / result.TotalAmount * 100
+	}
+
+	var cumAmount float64
+	var cumCount int
+	for i, g := range groups {
+		cumAmount += g.Amount
+		cumCount += g.Count
+		result.Items = append(result.Items, model.TopItem{
+			Rank:               i + 1,
+			Key:                g.Key,
+			Amount:             g.Amount,
+			Count:              g.Count,
+			SharePct:           share(g.Amount),
+			CumulativeSharePct: share(cumAmount),
+		})
+	}
+
+	if rest := result.Groups - len(groups); rest > 0 {
+		others := result.TotalAmount - cumAmount
+		result.Others = &model.TopOthers{Groups: rest, Amount: others, Count: result.TotalCount - cumCount, SharePct: share(others)}
+	}
+	return result
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+func TestBuildTopBreakdown(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		// итоги выборки запрос повторяет в каждой строке
+		totalAmount      float64
+		totalCount       int
+		groups, pareto   int
+		rows             []model.TopGroup
+		wantItems        []model.TopItem
+		wantOthers       *model.TopOthers
+		wantGroups       int
+		wantParetoGroups int
+		wantTotalAmount  float64
+		wantTotalCount   int
+	}{
+		{
+			name:        "all groups fit",
+			n:           5,
+			totalAmount: 1000, totalCount: 4, groups: 2, pareto: 1,
+			rows: []model.TopGroup{{Key: "food", Amount: 800, Count: 3}, {Key: "health", Amount: 200, Count: 1}},
+			wantItems: []model.TopItem{
+				{Rank: 1, Key: "food", Amount: 800, Count: 3, SharePct: 80, CumulativeSharePct: 80},
+				{Rank: 2, Key: "health", Amount: 200, Count: 1, SharePct: 20, CumulativeSharePct: 100},
+			},
+			wantGroups: 2, wantParetoGroups: 1, wantTotalAmount: 1000, wantTotalCount: 4,
+		},
+		{
+			// 5 групп на 1000 / 10 операций, в топ попали 2
+			name:        "others",
+			n:           2,
+			totalAmount: 1000, totalCount: 10, groups: 5, pareto: 3,
+			rows: []model.TopGroup{{Key: "food", Amount: 500, Count: 4}, {Key: "", Amount: 250, Count: 1}},
+			wantItems: []model.TopItem{
+				{Rank: 1, Key: "food", Amount: 500, Count: 4, SharePct: 50, CumulativeSharePct: 50},
+				{Rank: 2, Key: "", Amount: 250, Count: 1, SharePct: 25, CumulativeSharePct: 75},
+			},
+			wantOthers: &model.TopOthers{Groups: 3, Amount: 250, Count: 5, SharePct: 25},
+			wantGroups: 5, wantParetoGroups: 3, wantTotalAmount: 1000, wantTotalCount: 10,
+		},
+		{
+			name:        "zero total",
+			n:           1,
+			totalAmount: 0, totalCount: 2, groups: 3, pareto: 0,
+			rows:       []model.TopGroup{{Key: "food", Amount: 0, Count: 1}},
+			wantItems:  []model.TopItem{{Rank: 1, Key: "food", Count: 1}},
+			wantOthers: &model.TopOthers{Groups: 2, Count: 1},
+			wantGroups: 3, wantTotalCount: 2,
+		},
+		{
+			name:      "empty",
+			n:         10,
+			wantItems: []model.TopItem{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			by, opType, n := model.GroupByCategory, model.OpTypeCredit, tt.n
+			req := &model.RequestParamTop{By: &by, N: &n, OperationFilter: model.OperationFilter{Type: &opType}}
+			for i := range tt.rows {
+				tt.rows[i].TotalAmount, tt.rows[i].TotalCount = tt.totalAmount, tt.totalCount
+				tt.rows[i].Groups, tt.rows[i].Pareto = tt.groups, tt.pareto
+			}
+
+			got := buildTopBreakdown(req, tt.rows)
+			if got.Items == nil || !slices.Equal(got.Items, tt.wantItems) {
+				t.Errorf("items = %+v, want %+v", got.Items, tt.wantItems)
+			}
+			if (got.Others == nil) != (tt.wantOthers == nil) || (got.Others != nil && *got.Others != *tt.wantOthers) {
+				t.Errorf("others = %+v, want %+v", got.Others, tt.wantOthers)
+			}
+			if got.Groups != tt.wantGroups || got.ParetoGroups != tt.wantParetoGroups ||
+				got.TotalAmount != tt.wantTotalAmount || got.TotalCount != tt.wantTotalCount {
+				t.Errorf("totals = %+v", got)
+			}
+			if got.N != tt.n || got.By != model.GroupByCategory {
+				t.Errorf("n = %d, by = %q, want %d and %q", got.N, got.By, tt.n, model.GroupByCategory)
+			}
+		})
+	}
+}
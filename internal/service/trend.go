@@ -0,0 +1,240 @@
+package service
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+// validateTrend разбирает moving_avg/ema/trend: серии строятся по единственному временному измерению,
+// а страница групп оборвала бы серии на середине
+func validateTrend(rpa *model.RequestParamAnalytics) error {
+	if rpa.MovingAvg != nil {
+		values := splitListValues([]string{*rpa.MovingAvg})
+		if len(values) == 0 || len(values) > model.MaxMovingAvgs {
+			return model.ErrInvalidMovingAvg
+		}
+		windows := make([]int, 0, len(values))
+		for _, v := range values {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 2 || n > model.MaxMovingAvgWindow || slices.Contains(windows, n) {
+				return model.ErrInvalidMovingAvg
+			}
+			windows = append(windows, n)
+		}
+		rpa.Windows = windows
+	}
+	if rpa.EMA != nil && !(*rpa.EMA > 0 && *rpa.EMA <= 1) {
+		return model.ErrInvalidEMA
+	}
+	if rpa.TrendMetric != nil {
+		if _, ok := model.TrendMetricMap[*rpa.TrendMetric]; !ok {
+			return model.ErrInvalidTrendMetric
+		}
+	}
+
+	if !trendRequested(rpa) {
+		return nil
+	}
+	if trendTimeDim(rpa.Dimensions) < 0 || rpa.Page != nil || rpa.Limit != nil {
+		return model.ErrInvalidTrendGroupBy
+	}
+	return nil
+}
+
+func trendRequested(rpa *model.RequestParamAnalytics) bool {
+	return len(rpa.Windows) > 0 || rpa.EMA != nil || rpa.Trend
+}
+
+// trendTimeDim - индекс единственного временного измерения; -1, если его нет или их несколько
+func trendTimeDim(dims []string) int {
+	idx := -1
+	for i, dim := range dims {
+		switch dim {
+		case model.GroupByDay, model.GroupByWeek, model.GroupByMonth, model.GroupByYear:
+			if idx >= 0 {
+				return -1
+			}
+			idx = i
+		}
+	}
+	return idx
+}
+
+// trendKeys - колонки тренда в CSV в порядке запроса
+func trendKeys(rpa *model.RequestParamAnalytics) []string {
+	keys := make([]string, 0, len(rpa.Windows)+3)
+	for _, n := range rpa.Windows {
+		keys = append(keys, movingAvgKey(n))
+	}
+	if rpa.EMA != nil {
+		keys = append(keys, "ema")
+	}
+	if rpa.Trend {
+		keys = append(keys, "trend_slope", "trend_fitted")
+	}
+	return keys
+}
+
+func movingAvgKey(n int) string {
+	return "ma" + strconv.Itoa(n)
+}
+
+// bucketOrdinal переводит ISO-дату начала интервала в номер на общей оси: дни для day/week, месяцы, годы
+func bucketOrdinal(dim, key string) (int, bool) {
+	t, err := time.Parse("2006-01-02", key)
+	if err != nil {
+		return 0, false
+	}
+	switch dim {
+	case model.GroupByMonth:
+		return t.Year()*12 + int(t.Month()) - 1, true
+	case model.GroupByYear:
+		return t.Year(), true
+	default:
+		return int(t.Unix() / 86400), true
+	}
+}
+
+// applyTrend считает скользящие средние, EMA и линейный тренд по каждой серии.
+// Все серии кладутся на общую ось интервалов от первого до последнего в ответе; интервал без операций - это 0
+// для sum/income/expense/count, поэтому окна и регрессия не зависят от того, включен ли fill
+func applyTrend(rpa *model.RequestParamAnalytics, groups []model.AnalyticsQuantum) {
+	timeDim := trendTimeDim(rpa.Dimensions)
+	if timeDim < 0 || len(groups) == 0 {
+		return
+	}
+	dim := rpa.Dimensions[timeDim]
+	step := 1
+	if dim == model.GroupByWeek {
+		step = 7
+	}
+	metric := model.MetricSum
+	if rpa.TrendMetric != nil {
+		metric = *rpa.TrendMetric
+	}
+
+	// раскладываем группы по сериям - ключ из значений остальных измерений
+	type point struct {
+		group int
+		pos   int
+	}
+	series := make(map[string][]point)
+	order := make([]string, 0)
+	positions := make([]int, len(groups))
+	first, last := 0, 0
+	for i, g := range groups {
+		ord, ok := bucketOrdinal(dim, g.Keys[dim])
+		if !ok {
+			return
+		}
+		positions[i] = ord
+		if i == 0 || ord < first {
+			first = ord
+		}
+		if i == 0 || ord > last {
+			last = ord
+		}
+	}
+	for i, g := range groups {
+		parts := make([]string, 0, len(rpa.Dimensions)-1)
+		for j, d := range rpa.Dimensions {
+			if j != timeDim {
+				parts = append(parts, g.Keys[d])
+			}
+		}
+		key := strings.Join(parts, model.GroupKeySeparator)
+		if _, ok := series[key]; !ok {
+			order = append(order, key)
+		}
+		series[key] = append(series[key], point{group: i, pos: (positions[i] - first) / step})
+	}
+
+	length := (last-first)/step + 1
+	for _, key := range order {
+		values := make([]float64, length)
+		for _, p := range series[key] {
+			values[p.pos] = trendMetricValue(groups[p.group], metric)
+		}
+		prefix := make([]float64, length+1) // префиксные суммы - для окон скользящего среднего
+		for i, v := range values {
+			prefix[i+1] = prefix[i] + v
+		}
+		ema := emaSeries(values, rpa.EMA)
+		slope, intercept := linearTrend(values)
+
+		for _, p := range series[key] {
+			trend := &model.AnalyticsTrend{}
+			if len(rpa.Windows) > 0 {
+				trend.MovingAvg = make(map[string]*float64, len(rpa.Windows))
+				for _, n := range rpa.Windows {
+					var avg *float64
+					if p.pos+1 >= n { // окно целиком внутри оси
+						v := (prefix[p.pos+1] - prefix[p.pos+1-n]) / float64(n)
+						avg = &v
+					}
+					trend.MovingAvg[movingAvgKey(n)] = avg
+				}
+			}
+			if ema != nil {
+				v := ema[p.pos]
+				trend.EMA = &v
+			}
+			if rpa.Trend {
+				s, fitted := slope, intercept+slope*float64(p.pos)
+				trend.Slope, trend.Fitted = &s, &fitted
+			}
+			groups[p.group].Trend = trend
+		}
+	}
+}
+
+func trendMetricValue(g model.AnalyticsQuantum, metric string) float64 {
+	switch metric {
+	case model.TrendMetricIncome:
+		return g.Income.Sum
+	case model.TrendMetricExpense:
+		return g.Expense.Sum
+	case model.MetricCount:
+		return float64(g.Count)
+	default:
+		return g.Sum
+	}
+}
+
+// emaSeries - экспоненциальное сглаживание, стартует с первого значения оси
+func emaSeries(values []float64, alpha *float64) []float64 {
+	if alpha == nil {
+		return nil
+	}
+	result := make([]float64, len(values))
+	for i, v := range values {
+		if i == 0 {
+			result[i] = v
+			continue
+		}
+		result[i] = *alpha*v + (1-*alpha)*result[i-1]
+	}
+	return result
+}
+
+// linearTrend - наименьшие квадраты по точкам (i, values[i]); по одной точке наклон 0
+func linearTrend(values []float64) (slope, intercept float64) {
+	n := float64(len(values))
+	var sumX, sumY, sumXY, sumXX float64
+	for i, v := range values {
+		x := float64(i)
+		sumX += x
+		sumY += v
+		sumXY += x * v
+		sumXX += x * x
+	}
+	if denom := n*sumXX - sumX*sumX; denom != 0 {
+		slope = (n*sumXY - sumX*sumY) / denom
+	}
+	intercept = (sumY - slope*sumX) / n
+	return slope, intercept
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"math"
+	"testing"
+
+	"github.com/UnendingLoop/SalesTracker/internal/model"
+)
+
+func quantum(sum float64, keys ...string) model.AnalyticsQuantum {
+	q := model.AnalyticsQuantum{Sum: sum, Keys: map[string]string{}}
+	for i := 0; i+1 < len(keys); i += 2 {
+		q.Keys[keys[i]] = keys[i+1]
+	}
+	return q
+}
+
+func floatPtrEqual(got *float64, want *float64) bool {
+	if got == nil || want == nil {
+		return got == want
+	}
+	return math.Abs(*got-*want) < 1e-9
+}
+
+func f64(v float64) *float64 {
+	return &v
+}
+
+func TestApplyTrendMovingAverageWindow(t *testing.T) {
+	rpa := &model.RequestParamAnalytics{Dimensions: []string{model.GroupByDay}, Windows: []int{3}}
+	groups := []model.AnalyticsQuantum{
+		quantum(10, "day", "2026-01-01"),
+		quantum(20, "day", "2026-01-02"),
+		quantum(30, "day", "2026-01-03"),
+		quantum(60, "day", "2026-01-05"), // 2026-01-04 без операций - в окно входит нулем
+	}
+	applyTrend(rpa, groups)
+
+	want := []*float64{nil, nil, f64(20), f64(30)}
+	for i, g := range groups {
+		if g.Trend == nil {
+			t.Fatalf("[%d] trend is nil", i)
+		}
+		if got := g.Trend.MovingAvg["ma3"]; !floatPtrEqual(got, want[i]) {
+			t.Errorf("[%d] ma3 = %v, want %v", i, got, want[i])
+		}
+		if g.Trend.EMA != nil || g.Trend.Slope != nil {
+			t.Errorf("[%d] ema/slope are set without ema/trend", i)
+		}
+	}
+}
+
+func TestApplyTrendMultiSeries(t *testing.T) {
+	rpa := &model.RequestParamAnalytics{Dimensions: []string{model.GroupByMonth, model.GroupByCategory}, Windows: []int{2}, Trend: true}
+	// группы идут в порядке БД: по месяцу, затем по категории
+	groups := []model.AnalyticsQuantum{
+		quantum(100, "month", "2026-01-01", "category", "food"),
+		quantum(10, "month", "2026-01-01", "category", "health"),
+		quantum(300, "month", "2026-02-01", "category", "food"),
+		quantum(10, "month", "2026-03-01", "category", "health"),
+	}
+	applyTrend(rpa, groups)
+
+	tests := []struct {
+		idx        int
+		ma2        *float64
+		slope      float64
+		fittedWant float64
+	}{
+		// food: [100, 300, 0] на общей оси январь-март
+		{0, nil, -50, 183.33333333333334},
+		{2, f64(200), -50, 133.33333333333334},
+		// health: [10, 0, 10]
+		{1, nil, 0, 6.666666666666667},
+		{3, f64(5), 0, 6.666666666666667},
+	}
+	for _, tt := range tests {
+		trend := groups[tt.idx].Trend
+		if got := trend.MovingAvg["ma2"]; !floatPtrEqual(got, tt.ma2) {
+			t.Errorf("[%d] ma2 = %v, want %v", tt.idx, got, tt.ma2)
+		}
+		if !floatPtrEqual(trend.Slope, &tt.slope) {
+			t.Errorf("[%d] slope = %v, want %v", tt.idx, *trend.Slope, tt.slope)
+		}
+		if !floatPtrEqual(trend.Fitted, &tt.fittedWant) {
+			t.Errorf("[%d] fitted = %v, want %v", tt.idx, *trend.Fitted, tt.fittedWant)
+		}
+	}
+}
+
+func TestApplyTrendWeekStep(t *testing.T) {
+	alpha := 0.5
+	rpa := &model.RequestParamAnalytics{Dimensions: []string{model.GroupByWeek}, Windows: []int{2}, EMA: &alpha}
+	groups := []model.AnalyticsQuantum{
+		quantum(40, "week", "2026-01-05"),
+		quantum(80, "week", "2026-01-19"), // неделя 2026-01-12 пропущена
+	}
+	applyTrend(rpa, groups)
+
+	if got := groups[1].Trend.MovingAvg["ma2"]; !floatPtrEqual(got, f64(40)) {
+		t.Errorf("ma2 = %v, want 40 - пропущенная неделя считается нулем", got)
+	}
+	// ema по оси [40, 0, 80]: 40 -> 20 -> 50
+	if got := groups[1].Trend.EMA; !floatPtrEqual(got, f64(50)) {
+		t.Errorf("ema = %v, want 50", got)
+	}
+}
+
+func TestApplyTrendWithoutTimeDimension(t *testing.T) {
+	rpa := &model.RequestParamAnalytics{Dimensions: []string{model.GroupByCategory}, Trend: true}
+	groups := []model.AnalyticsQuantum{quantum(1, "category", "food")}
+	applyTrend(rpa, groups)
+	if groups[0].Trend != nil {
+		t.Errorf("trend = %+v, want nil without a time dimension", groups[0].Trend)
+	}
+}
+
+func TestLinearTrend(t *testing.T) {
+	tests := []struct {
+		name          string
+		values        []float64
+		wantSlope     float64
+		wantIntercept float64
+	}{
+		{"known line", []float64{1, 3, 5, 7}, 2, 1},
+		{"flat", []float64{5, 5, 5}, 0, 5},
+		{"single point", []float64{42}, 0, 42},
+		{"noisy", []float64{0, 2, 1, 3}, 0.8, 0.3},
+	}
+	for _, tt := range tests {
+		slope, intercept := linearTrend(tt.values)
+		if math.Abs(slope-tt.wantSlope) > 1e-9 || math.Abs(intercept-tt.wantIntercept) > 1e-9 {
+			t.Errorf("%s: linearTrend = (%v, %v), want (%v, %v)", tt.name, slope, intercept, tt.wantSlope, tt.wantIntercept)
+		}
+	}
+}
+
+func TestEMASeries(t *testing.T) {
+	if got := emaSeries([]float64{1, 2}, nil); got != nil {
+		t.Errorf("emaSeries without alpha = %v, want nil", got)
+	}
+
+	alpha := 0.5
+	got := emaSeries([]float64{10, 20, 0}, &alpha)
+	want := []float64{10, 15, 7.5}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			t.Errorf("emaSeries[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/UnendingLoop/SalesTracker/internal/model"
 	"github.com/gin-gonic/gin"
@@ -19,11 +23,24 @@ type OperationHandler struct {
 }
 
 type OperationService interface {
-	CreateOperation(ctx context.Context, newOp *model.Operation) error
+	CreateOperation(ctx context.Context, newOp *model.Operation, idempotencyKey string) (*model.Operation, *model.IdempotentResponse, error)
 	GetOperationByID(ctx context.Context, id int) (*model.Operation, error)
 	GetAllOperations(ctx context.Context, rpo *model.RequestParamOperations) ([]model.Operation, error)
-	UpdateOperationByID(ctx context.Context, op *model.Operation) error
+	GetOperationsPage(ctx context.Context, rpo *model.RequestParamOperations) (*model.OperationsPage, error)
+	GetOperationsEnvelope(ctx context.Context, rpo *model.RequestParamOperations) (*model.OperationsEnvelope, error)
+	SearchOperations(ctx context.Context, rps *model.RequestParamSearch) ([]model.SearchHit, error)
+	ReplaceOperationByID(ctx context.Context, op *model.Operation) (*model.Operation, error)
+	PatchOperationByID(ctx context.Context, id int64, patch []byte) (*model.Operation, error)
 	DeleteOperationByID(ctx context.Context, id int) error
+	BatchOperations(ctx context.Context, req *model.BatchRequest) (*model.BatchResult, []error, error)
+	BulkUpdateOperations(ctx context.Context, req *model.BulkUpdateRequest) (*model.BulkUpdateResult, error)
+	AnalyticsLocation(tz *string) (*time.Location, error)
+	GetCashflow(ctx context.Context, rpc *model.RequestParamCashflow) (*model.Cashflow, error)
+	GetForecast(ctx context.Context, rpf *model.RequestParamForecast) (*model.Forecast, error)
+	GetTop(ctx context.Context, rpt *model.RequestParamTop) (*model.TopBreakdown, error)
+	GetHistogram(ctx context.Context, rph *model.RequestParamHistogram) (*model.Histogram, error)
+	GetAnomalies(ctx context.Context, rpa *model.RequestParamAnomalies) (*model.Anomalies, error)
+	GetAnalyticsPivot(ctx context.Context, rpp *model.RequestParamPivot) (*model.PivotTable, error)
 	GetAnalytics(ctx context.Context, rpa *model.RequestParamAnalytics) (*model.AnalyticsSummary, error)
 }
 
@@ -43,12 +60,20 @@ func (h *OperationHandler) CreateOperation(ctx *ginext.Context) {
 		return
 	}
 
-	if err := h.svc.CreateOperation(ctx.Request.Context(), &newOp); err != nil {
+	// повтор с тем же Idempotency-Key вернет результат первого запроса
+	res, stored, err := h.svc.CreateOperation(ctx.Request.Context(), &newOp, ctx.GetHeader("Idempotency-Key"))
+	if err != nil {
 		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.Status(http.StatusNoContent)
+	ctx.Header("Location", "/operations/"+strconv.FormatInt(res.ID, 10))
+	if stored != nil {
+		// ответ, сохраненный с ключом, - байт в байт тот же, что получил первый запрос
+		ctx.Data(stored.Status, "application/json; charset=utf-8", stored.Body)
+		return
+	}
+	ctx.JSON(http.StatusCreated, res)
 }
 
 func (h *OperationHandler) GetOperationByID(ctx *ginext.Context) {
@@ -77,12 +102,34 @@ func (h *OperationHandler) GetOperationByID(ctx *ginext.Context) {
 func (h *OperationHandler) GetAllOperations(ctx *ginext.Context) {
 	// парсим параметры запроса операций из URL
 	rpo := model.RequestParamOperations{}
-	decoder := form.NewDecoder()
-	if err := decoder.Decode(&rpo, ctx.Request.URL.Query()); err != nil {
+	if err := decodeQueryParams(ctx, &rpo); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// пагинация курсорами отвечает конвертом со ссылками на соседние страницы
+	if rpo.Cursor != nil || (rpo.Pagination != nil && *rpo.Pagination == model.PaginationCursor) {
+		page, err := h.svc.GetOperationsPage(ctx.Request.Context(), &rpo)
+		if err != nil {
+			ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, page)
+		return
+	}
+
+	// конверт с итогами и ссылками на страницы в заголовке Link
+	if rpo.Envelope {
+		env, err := h.svc.GetOperationsEnvelope(ctx.Request.Context(), &rpo)
+		if err != nil {
+			ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Header("Link", pageLinks(ctx.Request.URL, env))
+		ctx.JSON(http.StatusOK, env)
+		return
+	}
+
 	// вызывваем сервис
 	res, err := h.svc.GetAllOperations(ctx.Request.Context(), &rpo)
 	if err != nil {
@@ -93,6 +140,24 @@ func (h *OperationHandler) GetAllOperations(ctx *ginext.Context) {
 	ctx.JSON(http.StatusOK, res)
 }
 
+func (h *OperationHandler) SearchOperations(ctx *ginext.Context) {
+	// парсим поисковую строку и параметры запроса операций из URL
+	rps := model.RequestParamSearch{}
+	if err := decodeQueryParams(ctx, &rps); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.SearchOperations(ctx.Request.Context(), &rps)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
 func (h *OperationHandler) UpdateOperationByID(ctx *ginext.Context) {
 	// читаем id из params
 	idRaw, ok := ctx.Params.Get("id")
@@ -106,7 +171,45 @@ func (h *OperationHandler) UpdateOperationByID(ctx *ginext.Context) {
 		return
 	}
 
-	// читаем JSON
+	// PATCH принимает JSON Merge Patch (RFC 7396)
+	contentType := ctx.ContentType()
+	if contentType != "application/merge-patch+json" && contentType != "application/json" {
+		ctx.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "content type must be application/merge-patch+json"})
+		return
+	}
+
+	// читаем патч как есть - какие поля пришли, решает сервис
+	patch, err := ctx.GetRawData()
+	if err != nil {
+		log.Printf("failed to read operation patch: %q", err.Error())
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid operation payload"})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.PatchOperationByID(ctx.Request.Context(), id, patch)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	respondUpdated(ctx, res)
+}
+
+func (h *OperationHandler) ReplaceOperationByID(ctx *ginext.Context) {
+	// читаем id из params
+	idRaw, ok := ctx.Params.Get("id")
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "operation id is missing"})
+		return
+	}
+	id, err := strconv.ParseInt(idRaw, 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "failed to process specified operation id"})
+		return
+	}
+
+	// читаем JSON - операция целиком
 	var op model.Operation
 	if err := ctx.ShouldBindJSON(&op); err != nil {
 		log.Printf("failed to parse operation payload: %q", err.Error())
@@ -116,12 +219,13 @@ func (h *OperationHandler) UpdateOperationByID(ctx *ginext.Context) {
 	op.ID = id
 
 	// вызываем сервис
-	if err := h.svc.UpdateOperationByID(ctx.Request.Context(), &op); err != nil {
+	res, err := h.svc.ReplaceOperationByID(ctx.Request.Context(), &op)
+	if err != nil {
 		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
 		return
 	}
 
-	ctx.Status(http.StatusNoContent)
+	respondUpdated(ctx, res)
 }
 
 func (h *OperationHandler) DeleteOperationByID(ctx *ginext.Context) {
@@ -146,12 +250,69 @@ func (h *OperationHandler) DeleteOperationByID(ctx *ginext.Context) {
 	ctx.Status(http.StatusNoContent)
 }
 
+func (h *OperationHandler) BatchOperations(ctx *ginext.Context) {
+	// читаем JSON со списком команд
+	var req model.BatchRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		log.Printf("failed to parse batch payload: %q", err.Error())
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid batch payload"})
+		return
+	}
+
+	// вызываем сервис
+	res, itemErrs, err := h.svc.BatchOperations(ctx.Request.Context(), &req)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// проставляем каждой команде код, который вернула бы одиночная ручка
+	status := http.StatusOK
+	for i := range res.Results {
+		item := &res.Results[i]
+		if itemErrs[i] != nil {
+			item.Status = errCodeDefiner(itemErrs[i])
+			item.Error = itemErrs[i].Error()
+			status = http.StatusMultiStatus
+			continue
+		}
+		switch item.Action {
+		case model.BatchCreate:
+			item.Status = http.StatusCreated
+		case model.BatchDelete:
+			item.Status = http.StatusNoContent
+		default:
+			item.Status = http.StatusOK
+		}
+	}
+
+	ctx.JSON(status, res)
+}
+
+func (h *OperationHandler) BulkUpdateOperations(ctx *ginext.Context) {
+	// читаем JSON с фильтром и изменениями
+	var req model.BulkUpdateRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		log.Printf("failed to parse bulk update payload: %q", err.Error())
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid bulk update payload"})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.BulkUpdateOperations(ctx.Request.Context(), &req)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
 func (h *OperationHandler) GetAnalytics(ctx *ginext.Context) {
 	// парсим параметры запроса аналитики из URL
 	rpa := model.RequestParamAnalytics{}
-	decoder := form.NewDecoder()
-	if err := decoder.Decode(&rpa, ctx.Request.URL.Query()); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := h.decodeAnalyticsParams(ctx, &rpa); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
 		return
 	}
 	// вызываем сервис
@@ -165,6 +326,114 @@ func (h *OperationHandler) GetAnalytics(ctx *ginext.Context) {
 	ctx.JSON(http.StatusOK, res)
 }
 
+func (h *OperationHandler) GetAnalyticsPivot(ctx *ginext.Context) {
+	// парсим параметры сводной таблицы из URL
+	rpp := model.RequestParamPivot{}
+	if err := h.decodeAnalyticsParams(ctx, &rpp); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.GetAnalyticsPivot(ctx.Request.Context(), &rpp)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (h *OperationHandler) GetCashflow(ctx *ginext.Context) {
+	// парсим параметры денежного потока из URL
+	rpc := model.RequestParamCashflow{}
+	if err := h.decodeAnalyticsParams(ctx, &rpc); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.GetCashflow(ctx.Request.Context(), &rpc)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (h *OperationHandler) GetForecast(ctx *ginext.Context) {
+	// парсим параметры прогноза из URL
+	rpf := model.RequestParamForecast{}
+	if err := h.decodeAnalyticsParams(ctx, &rpf); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.GetForecast(ctx.Request.Context(), &rpf)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (h *OperationHandler) GetTop(ctx *ginext.Context) {
+	// парсим параметры топа из URL
+	rpt := model.RequestParamTop{}
+	if err := h.decodeAnalyticsParams(ctx, &rpt); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.GetTop(ctx.Request.Context(), &rpt)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (h *OperationHandler) GetHistogram(ctx *ginext.Context) {
+	// парсим параметры гистограммы из URL
+	rph := model.RequestParamHistogram{}
+	if err := h.decodeAnalyticsParams(ctx, &rph); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.GetHistogram(ctx.Request.Context(), &rph)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (h *OperationHandler) GetAnomalies(ctx *ginext.Context) {
+	// парсим параметры поиска аномалий из URL
+	rpa := model.RequestParamAnomalies{}
+	if err := h.decodeAnalyticsParams(ctx, &rpa); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// вызываем сервис
+	res, err := h.svc.GetAnomalies(ctx.Request.Context(), &rpa)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
 func (h *OperationHandler) ExportOperationsCSV(ctx *ginext.Context) {
 	// парсим параметры запроса операций из URL
 	rpo := model.RequestParamOperations{}
@@ -199,8 +468,8 @@ func (h *OperationHandler) ExportOperationsCSV(ctx *ginext.Context) {
 func (h *OperationHandler) ExportAnalyticsCSV(ctx *ginext.Context) {
 	// парсим параметры запроса аналитики из URL
 	rpa := model.RequestParamAnalytics{}
-	if err := decodeQueryParams(ctx, &rpa); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := h.decodeAnalyticsParams(ctx, &rpa); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
 		return
 	}
 
@@ -227,46 +496,257 @@ func (h *OperationHandler) ExportAnalyticsCSV(ctx *ginext.Context) {
 	}
 }
 
+func (h *OperationHandler) ExportAnalyticsPivotCSV(ctx *ginext.Context) {
+	// парсим параметры сводной таблицы из URL
+	rpp := model.RequestParamPivot{}
+	if err := h.decodeAnalyticsParams(ctx, &rpp); err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := h.svc.GetAnalyticsPivot(ctx.Request.Context(), &rpp)
+	if err != nil {
+		ctx.JSON(errCodeDefiner(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	// устанавливаем хедеры под CSV
+	ctx.Writer.Header().Set("Cache-Control", "no-store")
+	ctx.Writer.Header().Set("Pragma", "no-cache")
+	ctx.Writer.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+	ctx.Writer.Header().Set("Content-Type", "text/csv")
+	ctx.Writer.Header().Set("Content-Disposition", "attachment; filename=pivot.csv")
+
+	// пишем данные
+	rows := convertPivotToCSV(res)
+	writer := csv.NewWriter(ctx.Writer)
+	if err := writer.WriteAll(rows); err != nil {
+		log.Printf("failed to Flush csv-writer: %q", err.Error())
+		return
+	}
+}
+
 func convertAnalyticsToCSV(input *model.AnalyticsSummary) [][]string {
-	result := make([][]string, 0, len(input.Groups)+1)
-	start := []string{"group_key", "total_amount", "average", "operations_in_group", "mediana", "P90"}
+	// по колонке на каждое измерение группировки; без группировки - одна колонка под метку итогов
+	dims := []string{"group_key"}
+	if input.Key != "" {
+		dims = strings.Split(input.Key, ",")
+	}
+
+	result := make([][]string, 0, len(input.Groups)+2)
+	start := append(append([]string{}, dims...), "total_amount", "average", "operations_in_group", "mediana", "P90", "income_total", "expense_total")
+	start = append(start, input.StatKeys...)  // колонки под запрошенные percentiles/stats
+	start = append(start, input.TrendKeys...) // колонки под moving_avg/ema/trend
 	result = append(result, start)
 
 	for _, v := range input.Groups {
 		row := make([]string, 0, len(start))
-		row = append(row, v.Key, strconv.FormatFloat(v.Sum/100, 'f', 2, 64), strconv.FormatFloat(v.Avg/100, 'f', 2, 64), strconv.Itoa(v.Count), strconv.FormatFloat(v.Median/100, 'f', 2, 64), strconv.FormatFloat(v.P90/100, 'f', 2, 64))
+		for _, dim := range dims {
+			row = append(row, v.Keys[dim])
+		}
+		if v.Gap { // пустой интервал при fill=null - пустые ячейки вместо нулей
+			row = append(row, "", "", "0")
+			row = append(row, make([]string, len(start)-len(row))...)
+			result = append(result, row)
+			continue
+		}
+		row = append(row, strconv.FormatFloat(v.Sum/100, 'f', 2, 64), strconv.FormatFloat(v.Avg/100, 'f', 2, 64), strconv.Itoa(v.Count), strconv.FormatFloat(v.Median/100, 'f', 2, 64), strconv.FormatFloat(v.P90/100, 'f', 2, 64), strconv.FormatFloat(v.Income.Sum/100, 'f', 2, 64), strconv.FormatFloat(v.Expense.Sum/100, 'f', 2, 64))
+		row = append(row, formatExtraStats(input.StatKeys, v.Stats)...)
+		row = append(row, formatTrend(input.TrendKeys, input.TrendMetric, v.Trend)...)
+		result = append(result, row)
+	}
+
+	end := make([]string, len(dims))
+	end[0] = "TOTALS:"
+	end = append(end, strconv.FormatFloat(input.Sum/100, 'f', 2, 64), strconv.FormatFloat(input.Avg/100, 'f', 2, 64), strconv.Itoa(input.Count), strconv.FormatFloat(input.Median/100, 'f', 2, 64), strconv.FormatFloat(input.P90/100, 'f', 2, 64), strconv.FormatFloat(input.Income.Sum/100, 'f', 2, 64), strconv.FormatFloat(input.Expense.Sum/100, 'f', 2, 64))
+	end = append(end, formatExtraStats(input.StatKeys, input.Stats)...)
+	end = append(end, make([]string, len(input.TrendKeys))...) // у итогов нет серии
+	result = append(result, end)
+	return result
+}
+
+// formatExtraStats выводит доп. статистику в порядке запроса; дисперсия - в квадратных копейках, поэтому переводится в рубли дважды
+func formatExtraStats(keys []string, stats map[string]float64) []string {
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		v := stats[key] / 100
+		if key == model.StatVariance {
+			v /= 100
+		}
+		result = append(result, strconv.FormatFloat(v, 'f', 2, 64))
+	}
+	return result
+}
+
+// formatTrend выводит колонки тренда в порядке TrendKeys; count - штуки, остальные метрики - в рублях.
+// Пустая ячейка - окно скользящего среднего еще не набралось
+func formatTrend(keys []string, metric string, trend *model.AnalyticsTrend) []string {
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		var v *float64
+		if trend != nil {
+			switch key {
+			case "ema":
+				v = trend.EMA
+			case "trend_slope":
+				v = trend.Slope
+			case "trend_fitted":
+				v = trend.Fitted
+			default:
+				v = trend.MovingAvg[key]
+			}
+		}
+		if v == nil {
+			result = append(result, "")
+			continue
+		}
+		value := *v
+		if metric != model.MetricCount {
+			value /= 100
+		}
+		result = append(result, strconv.FormatFloat(value, 'f', 2, 64))
+	}
+	return result
+}
+
+func convertPivotToCSV(input *model.PivotTable) [][]string {
+	// count - штуки, остальные метрики - копейки, которые выгружаем в рублях
+	format := func(v float64) string {
+		if input.Metric == model.MetricCount {
+			return strconv.FormatFloat(v, 'f', 0, 64)
+		}
+		return strconv.FormatFloat(v/100, 'f', 2, 64)
+	}
+
+	result := make([][]string, 0, len(input.RowKeys)+2)
+	start := append(append([]string{input.Rows + "/" + input.Cols}, input.ColKeys...), "TOTAL")
+	result = append(result, start)
+
+	for i, key := range input.RowKeys {
+		row := make([]string, 0, len(start))
+		row = append(row, key)
+		for _, v := range input.Cells[i] {
+			if v == nil {
+				row = append(row, "")
+				continue
+			}
+			row = append(row, format(*v))
+		}
+		row = append(row, format(input.RowTotals[i]))
 		result = append(result, row)
 	}
 
-	end := []string{"TOTALS:", strconv.FormatFloat(input.Sum/100, 'f', 2, 64), strconv.FormatFloat(input.Avg/100, 'f', 2, 64), strconv.Itoa(input.Count), strconv.FormatFloat(input.Median/100, 'f', 2, 64), strconv.FormatFloat(input.P90/100, 'f', 2, 64)}
+	end := make([]string, 0, len(start))
+	end = append(end, "TOTAL")
+	for _, v := range input.ColTotals {
+		end = append(end, format(v))
+	}
+	end = append(end, format(input.GrandTotal))
 	result = append(result, end)
 	return result
 }
 
 func convertOperationsToCSV(input []model.Operation) [][]string {
 	result := make([][]string, 0, len(input)+1)
-	start := []string{"id", "amount", "type", "category", "actor", "date", "created", "description"}
+	start := []string{"id", "amount", "type", "category", "actor", "date", "created", "description", "tags", "account"}
 	result = append(result, start)
 
 	for _, v := range input {
 		row := make([]string, 0, len(start))
-		descr := ""
+		descr, account := "", ""
 		if v.Description != nil {
 			descr = *v.Description
 		}
-		row = append(row, strconv.FormatInt(v.ID, 10), strconv.FormatFloat(float64(v.Amount)/100, 'f', 2, 64), v.Type, v.Category, v.Actor, v.OperationAt.Format("2006-01-02"), v.CreatedAt.Format("2006-01-02"), descr)
+		if v.Account != nil {
+			account = *v.Account
+		}
+		row = append(row, strconv.FormatInt(v.ID, 10), strconv.FormatFloat(float64(v.Amount)/100, 'f', 2, 64), v.Type, v.Category, v.Actor, v.OperationAt.Format("2006-01-02"), v.CreatedAt.Format("2006-01-02"), descr, strings.Join(v.Tags, ","), account)
 		result = append(result, row)
 	}
 
 	return result
 }
 
-func decodeQueryParams[T *model.RequestParamAnalytics | *model.RequestParamOperations](c *ginext.Context, input T) error {
-	decoder := form.NewDecoder()
-	if err := decoder.Decode(input, c.Request.URL.Query()); err != nil {
+// respondUpdated отдает обновленную операцию только по запросу клиента (Prefer: return=representation, RFC 7240)
+func respondUpdated(ctx *ginext.Context, op *model.Operation) {
+	for _, pref := range strings.Split(ctx.GetHeader("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), "return=representation") {
+			ctx.Header("Preference-Applied", "return=representation")
+			ctx.JSON(http.StatusOK, op)
+			return
+		}
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// pageLinks строит заголовок Link (RFC 8288) со ссылками first/prev/next/last - все параметры запроса, кроме page, сохраняются
+func pageLinks(u *url.URL, env *model.OperationsEnvelope) string {
+	last := 1
+	if env.TotalCount > 0 {
+		last = int((env.TotalCount + int64(env.Limit) - 1) / int64(env.Limit))
+	}
+
+	link := func(page int, rel string) string {
+		q := u.Query()
+		q.Set("page", strconv.Itoa(page))
+		q.Set("limit", strconv.Itoa(env.Limit))
+		return "<" + u.Path + "?" + q.Encode() + ">; rel=\"" + rel + "\""
+	}
+
+	links := []string{link(1, "first")}
+	if env.Page > 1 {
+		links = append(links, link(min(env.Page-1, last), "prev"))
+	}
+	if env.HasMore {
+		links = append(links, link(env.Page+1, "next"))
+	}
+	links = append(links, link(last, "last"))
+
+	return strings.Join(links, ", ")
+}
+
+func decodeQueryParams[T queryParams](c *ginext.Context, input T) error {
+	return newQueryDecoder(time.UTC).Decode(input, c.Request.URL.Query())
+}
+
+// decodeAnalyticsParams сначала определяет зону запроса (tz или зону по умолчанию), чтобы from/to без смещения читались в ней
+func (h *OperationHandler) decodeAnalyticsParams(c *ginext.Context, input any) error {
+	var tz *string
+	if v, ok := c.GetQuery("tz"); ok {
+		tz = &v
+	}
+	loc, err := h.svc.AnalyticsLocation(tz)
+	if err != nil {
 		return err
 	}
-	return nil
+
+	return newQueryDecoder(loc).Decode(input, c.Request.URL.Query())
+}
+
+type queryParams interface {
+	*model.RequestParamAnalytics | *model.RequestParamOperations | *model.RequestParamSearch | *model.RequestParamPivot
+}
+
+// newQueryDecoder - декодер query-параметров, в котором время без смещения (2026-01-01, 2026-01-01T10:00:00) читается в зоне loc
+func newQueryDecoder(loc *time.Location) *form.Decoder {
+	decoder := form.NewDecoder()
+	decoder.RegisterCustomTypeFunc(func(vals []string) (any, error) {
+		return parseQueryTime(vals[0], loc)
+	}, time.Time{})
+	return decoder
+}
+
+func parseQueryTime(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected RFC3339 or 2006-01-02[T15:04[:05]]", s)
 }
 
 func errCodeDefiner(err error) int {
@@ -275,6 +755,10 @@ func errCodeDefiner(err error) int {
 		return 500
 	case errors.Is(err, model.ErrOperationIDNotFound):
 		return 404
+	case errors.Is(err, model.ErrIdempotencyKeyReused):
+		return 422
+	case errors.Is(err, model.ErrBatchAborted):
+		return 424
 	default:
 		return 400
 	}